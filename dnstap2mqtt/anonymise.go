@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dichro/pubsub-logging/redact"
+	dnstap "github.com/dnstap/golang-dnstap"
+)
+
+var (
+	anonMode   = flag.String("client_anonymise", "", "how to anonymise query addresses on the raw and cooked topics: truncate, hmac, drop, or empty for none")
+	anonV4     = flag.Int("client_ipv4_prefix", 24, "prefix length to truncate IPv4 query addresses to")
+	anonV6     = flag.Int("client_ipv6_prefix", 48, "prefix length to truncate IPv6 query addresses to")
+	anonKey    = flag.String("client_hmac_key_file", "", "file containing the HMAC key for --client_anonymise=hmac")
+	anonRotate = flag.Duration("client_hmac_rotate", 24*time.Hour, "how often HMAC pseudonyms change, or 0 for never")
+	fullTopic  = flag.String("mqtt_topic_cooked_full", "", "MQTT topic to publish cooked dnstap messages with query addresses intact, for short-term retention")
+)
+
+// anonymiser rewrites the query addresses in dnstap messages.
+type anonymiser struct {
+	mode   string
+	v4, v6 int
+	hash   *redact.Hasher
+}
+
+// newAnonymiser returns an anonymiser for the given mode, or nil if mode is
+// empty.
+func newAnonymiser(mode string, v4, v6 int, keyFile string, rotate time.Duration) (*anonymiser, error) {
+	a := &anonymiser{mode: mode, v4: v4, v6: v6}
+	switch mode {
+	case "":
+		return nil, nil
+	case "truncate":
+		if v4 < 0 || v4 > 8*net.IPv4len {
+			return nil, fmt.Errorf("IPv4 prefix length %d out of range 0-%d", v4, 8*net.IPv4len)
+		}
+		if v6 < 0 || v6 > 8*net.IPv6len {
+			return nil, fmt.Errorf("IPv6 prefix length %d out of range 0-%d", v6, 8*net.IPv6len)
+		}
+	case "drop":
+	case "hmac":
+		key, err := redact.ReadKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.hash = redact.NewRotatingHasher(key, rotate)
+	default:
+		return nil, fmt.Errorf("unknown anonymisation mode %q", mode)
+	}
+	return a, nil
+}
+
+// anonymise rewrites the query address of m in place, and returns the string
+// to use for it in cooked messages. HMAC pseudonyms can't be represented as
+// addresses, so raw messages get the leading bytes of the decoded pseudonym instead.
+func (a *anonymiser) anonymise(m *dnstap.Message) string {
+	if m == nil {
+		return ""
+	}
+	ip := net.IP(m.QueryAddress)
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return ""
+	}
+	switch a.mode {
+	case "truncate":
+		m.QueryAddress = redact.TruncateIP(ip, a.v4, a.v6)
+		return ipString(m.QueryAddress)
+	case "hmac":
+		sum := a.hash.Sum(ip.String())
+		m.QueryAddress = redact.HexPrefix(sum, len(ip))
+		return sum
+	}
+	m.QueryAddress = nil
+	return ""
+}
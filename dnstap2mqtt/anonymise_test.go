@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/dichro/pubsub-logging/redact"
+	dnstap "github.com/dnstap/golang-dnstap"
+)
+
+func TestAnonymiser(t *testing.T) {
+	for _, tc := range []struct {
+		mode, addr string
+		cooked     string
+		raw        net.IP
+	}{
+		{"truncate", "192.168.8.68", "192.168.8.0", net.IPv4(192, 168, 8, 0).To4()},
+		{"truncate", "2001:db8:1:2::1", "2001:db8:1::", net.ParseIP("2001:db8:1::")},
+		{"drop", "192.168.8.68", "", nil},
+	} {
+		a, err := newAnonymiser(tc.mode, 24, 48, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := net.ParseIP(tc.addr)
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		m := &dnstap.Message{QueryAddress: ip}
+		if got := a.anonymise(m); got != tc.cooked {
+			t.Errorf("%s(%s) = %q; want %q", tc.mode, tc.addr, got, tc.cooked)
+		}
+		if !net.IP(m.QueryAddress).Equal(tc.raw) {
+			t.Errorf("%s(%s) raw = %v; want %v", tc.mode, tc.addr, net.IP(m.QueryAddress), tc.raw)
+		}
+	}
+	if a, err := newAnonymiser("", 24, 48, "", 0); a != nil || err != nil {
+		t.Errorf("newAnonymiser(\"\") = %v, %v; want nil, nil", a, err)
+	}
+	if _, err := newAnonymiser("hmac", 24, 48, "/nonexistent", 0); err == nil {
+		t.Error("newAnonymiser(hmac) without key succeeded")
+	}
+	for _, p := range [][2]int{{33, 48}, {-1, 48}, {24, 129}} {
+		if _, err := newAnonymiser("truncate", p[0], p[1], "", 0); err == nil {
+			t.Errorf("newAnonymiser(truncate, %d, %d) succeeded", p[0], p[1])
+		}
+	}
+}
+
+func TestAnonymiser_HMAC(t *testing.T) {
+	h := redact.NewRotatingHasher([]byte("secret"), 0)
+	a := &anonymiser{mode: "hmac", hash: h}
+	for _, addr := range []string{"192.168.8.68", "2001:db8:1:2::1"} {
+		ip := net.ParseIP(addr)
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		m := &dnstap.Message{QueryAddress: ip}
+		sum := h.Sum(ip.String())
+		if got := a.anonymise(m); got != sum {
+			t.Errorf("hmac(%s) = %q; want %q", addr, got, sum)
+		}
+		want, err := hex.DecodeString(sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(m.QueryAddress, want[:len(ip)]) {
+			t.Errorf("hmac(%s) raw = %x; want %x", addr, m.QueryAddress, want[:len(ip)])
+		}
+	}
+}
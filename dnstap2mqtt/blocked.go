@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dichro/pubsub-logging/dnstap2mqtt/blocklist"
+	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	blocklists     namedFiles
+	blockedTopic   = flag.String("mqtt_topic_blocked", "dnstap/blocked/json", "MQTT topic to publish cooked dnstap messages matching a blocklist, or empty to disable")
+	blocklistCheck = flag.Duration("blocklist_reload", 30*time.Second, "how often to check blocklist files for changes")
+
+	blocklistMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dnstap",
+		Name:      "blocklist_matches",
+		Help:      "count of dnstap messages matching a blocklist",
+	}, []string{"list"})
+	blocklistSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "dnstap",
+		Name:      "blocklist_domains",
+		Help:      "count of domains on a blocklist",
+	}, []string{"list"})
+)
+
+func init() {
+	flag.Var(&blocklists, "blocklist", "blocklist to tag messages with, as name=path; may be repeated")
+	prometheus.MustRegister(blocklistMatches)
+	prometheus.MustRegister(blocklistSize)
+}
+
+type namedFile struct {
+	name, path string
+}
+
+// namedFiles is a repeatable flag of name=path pairs. If the name is
+// omitted, the file's base name is used.
+type namedFiles []namedFile
+
+func (n *namedFiles) String() string {
+	var s []string
+	for _, f := range *n {
+		s = append(s, f.name+"="+f.path)
+	}
+	return strings.Join(s, ",")
+}
+
+func (n *namedFiles) Set(v string) error {
+	f := namedFile{path: v}
+	if i := strings.IndexByte(v, '='); i >= 0 {
+		f.name, f.path = v[:i], v[i+1:]
+	} else {
+		f.name = filepath.Base(v)
+	}
+	if f.name == "" || f.path == "" {
+		return fmt.Errorf("want name=path, got %q", v)
+	}
+	*n = append(*n, f)
+	return nil
+}
+
+// tagger annotates messages whose query names, or any names in the answer
+// chain, are on a blocklist, and publishes them separately.
+type tagger struct {
+	pub    *pub.Publisher
+	redact *redact.Redactor
+	lists  *blocklist.Set
+}
+
+func newTagger(p *pub.Publisher, r *redact.Redactor, files namedFiles) (*tagger, error) {
+	t := &tagger{pub: p, redact: r, lists: &blocklist.Set{}}
+	for _, f := range files {
+		if err := t.lists.Load(f.name, f.path); err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range t.lists.Lists() {
+		glog.Infof("loaded %d domains from blocklist %s", l.Len(), l.Name)
+		blocklistSize.WithLabelValues(l.Name).Set(float64(l.Len()))
+	}
+	return t, nil
+}
+
+// watch reloads blocklist files as they change.
+func (t *tagger) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, errs := t.lists.Reload()
+		for _, err := range errs {
+			glog.Error(err)
+		}
+		for _, l := range reloaded {
+			glog.Infof("reloaded %d domains from blocklist %s", l.Len(), l.Name)
+			blocklistSize.WithLabelValues(l.Name).Set(float64(l.Len()))
+		}
+	}
+}
+
+func (t *tagger) process(dt *DNSTap) {
+	seen := make(map[string]bool)
+	check := func(name string) {
+		name = strings.ToLower(name)
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		dt.Blocklist = append(dt.Blocklist, t.lists.Match(name)...)
+	}
+	for _, q := range dt.Message.Question {
+		check(q.Name)
+	}
+	for _, rr := range dt.Message.Answer {
+		check(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			check(rr.Target)
+		case *dns.DNAME:
+			check(rr.Target)
+		}
+	}
+	if len(dt.Blocklist) == 0 {
+		return
+	}
+	for _, m := range dt.Blocklist {
+		blocklistMatches.WithLabelValues(m.List).Inc()
+	}
+	if len(*blockedTopic) == 0 {
+		return
+	}
+	out, err := encode(t.redact, dt)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	t.pub.Go(*blockedTopic, out)
+}
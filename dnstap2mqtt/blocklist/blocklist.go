@@ -0,0 +1,287 @@
+// Package blocklist matches domain names against lists of blocked domains,
+// as distributed in hosts-file, adblock, RPZ zone or plain-domain format.
+//
+// Listing a domain blocks all of its subdomains too.
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Match describes a name found on a list.
+type Match struct {
+	// List is the name of the list.
+	List string `json:"list"`
+	// Domain is the listed domain.
+	Domain string `json:"domain"`
+	// Name is the name that matched, which is Domain or a subdomain of it.
+	Name string `json:"name"`
+}
+
+// List is a set of blocked domains.
+type List struct {
+	Name    string
+	domains map[string]struct{}
+}
+
+// hosts-file names that aren't meant as blocks.
+var ignored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// Parse reads a list, detecting the format of each line independently, so
+// that lists concatenated from several sources still parse.
+func Parse(name string, r io.Reader) (*List, error) {
+	l := &List{Name: name, domains: make(map[string]struct{})}
+	var origin string
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if cosmetic(line) {
+			continue
+		}
+		line = stripComment(line)
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch {
+		case strings.EqualFold(fields[0], "$ORIGIN") && len(fields) > 1:
+			origin = normalise(fields[1])
+		case fields[0][0] == '$':
+			// other zone file directives
+		case strings.HasPrefix(line, "||"):
+			// adblock: ||example.com^ or ||example.com^$third-party
+			d := strings.TrimPrefix(line, "||")
+			if i := strings.IndexAny(d, "^$/"); i >= 0 {
+				d = d[:i]
+			}
+			l.add(d)
+		case net.ParseIP(fields[0]) != nil:
+			// hosts: 0.0.0.0 example.com [more.example.com ...]
+			for _, d := range fields[1:] {
+				l.add(d)
+			}
+		case len(fields) > 1:
+			l.addRPZ(fields, origin)
+		case len(fields) == 1 && !strings.ContainsAny(line, "/@|^"):
+			l.add(line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return l, nil
+}
+
+// cosmetic reports whether line is an adblock element hiding, exception or
+// extended CSS rule, such as "example.com##.banner", which hides parts of
+// pages rather than blocking the domain.
+func cosmetic(line string) bool {
+	for _, sep := range []string{"##", "#@#", "#?#"} {
+		if strings.Contains(line, sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripComment removes a trailing comment: from a ";", or from a "#" at the
+// start of line or after whitespace.
+func stripComment(line string) string {
+	for i, c := range line {
+		if c == ';' || c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return line
+}
+
+// addRPZ adds the owner of an RPZ zone record that blocks it, such as
+// "bad.example.com CNAME ." or "*.bad.example.com.rpz.local. 300 IN CNAME *.".
+// Only NXDOMAIN (".") and NODATA ("*.") actions count as blocks; passthru
+// entries allow names, and other targets redirect them to a walled garden.
+func (l *List) addRPZ(fields []string, origin string) {
+	target := ""
+	for i, f := range fields[1:] {
+		switch strings.ToUpper(f) {
+		case "CNAME":
+			if i+2 < len(fields) {
+				target = fields[i+2]
+			}
+		case "SOA", "NS":
+			return
+		}
+	}
+	owner := fields[0]
+	if (target != "." && target != "*.") || owner == "@" {
+		return
+	}
+	owner = strings.TrimPrefix(owner, "*.")
+	if strings.HasSuffix(owner, ".") {
+		owner = normalise(owner)
+		if origin != "" {
+			if owner == origin {
+				return
+			}
+			owner = strings.TrimSuffix(owner, "."+origin)
+		}
+	}
+	l.add(owner)
+}
+
+func (l *List) add(domain string) {
+	d := normalise(domain)
+	if d == "" || ignored[d] {
+		return
+	}
+	l.domains[d] = struct{}{}
+}
+
+// Len returns the number of domains on the list.
+func (l *List) Len() int {
+	return len(l.domains)
+}
+
+// Match returns the listed domain that name is, or is a subdomain of.
+func (l *List) Match(name string) (string, bool) {
+	d := normalise(name)
+	for d != "" {
+		if _, ok := l.domains[d]; ok {
+			return d, true
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return "", false
+}
+
+func normalise(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// Set is a collection of lists loaded from files, which can be reloaded as
+// the files change. It is safe for concurrent use; lists are parsed without
+// blocking Match.
+type Set struct {
+	// loading serialises Load and Reload, which alone modify files.
+	loading sync.Mutex
+	mu      sync.RWMutex
+	files   []*file
+}
+
+type file struct {
+	name, path string
+	modTime    time.Time
+	size       int64
+	list       *List
+}
+
+// Load adds the list in the file at path to the set, under the given name.
+func (s *Set) Load(name, path string) error {
+	s.loading.Lock()
+	defer s.loading.Unlock()
+	f := &file{name: name, path: path}
+	l, st, err := f.read()
+	if err != nil {
+		return err
+	}
+	f.list, f.modTime, f.size = l, st.ModTime(), st.Size()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = append(s.files, f)
+	return nil
+}
+
+// read rereads the file if it has changed since it was last read, returning
+// a nil list if it hasn't.
+func (f *file) read() (*List, os.FileInfo, error) {
+	st, err := os.Stat(f.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.list != nil && st.ModTime().Equal(f.modTime) && st.Size() == f.size {
+		return nil, st, nil
+	}
+	r, err := os.Open(f.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	l, err := Parse(f.name, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, st, nil
+}
+
+// Reload rereads any files that have changed. Lists that fail to load are
+// left as they were; their errors are returned.
+func (s *Set) Reload() (reloaded []*List, errs []error) {
+	s.loading.Lock()
+	defer s.loading.Unlock()
+	s.mu.RLock()
+	files := append([]*file(nil), s.files...)
+	s.mu.RUnlock()
+	for _, f := range files {
+		l, st, err := f.read()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", f.path, err))
+			continue
+		}
+		if l == nil {
+			continue
+		}
+		s.mu.Lock()
+		f.list, f.modTime, f.size = l, st.ModTime(), st.Size()
+		s.mu.Unlock()
+		reloaded = append(reloaded, l)
+	}
+	return reloaded, errs
+}
+
+// Lists returns the current lists.
+func (s *Set) Lists() []*List {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	lists := make([]*List, len(s.files))
+	for i, f := range s.files {
+		lists[i] = f.list
+	}
+	return lists
+}
+
+// Match returns a Match for every list that name is on.
+func (s *Set) Match(name string) []Match {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var matches []Match
+	for _, f := range s.files {
+		if d, ok := f.list.Match(name); ok {
+			matches = append(matches, Match{List: f.name, Domain: d, Name: normalise(name)})
+		}
+	}
+	return matches
+}
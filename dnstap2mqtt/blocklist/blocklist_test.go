@@ -0,0 +1,124 @@
+package blocklist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mixed = `# hosts format
+0.0.0.0 ads.example.com tracker.example.net
+127.0.0.1 localhost
+::1 ip6-localhost
+! adblock format
+||doubleclick.net^
+||metrics.example.org^$third-party
+example.com##.banner
+news.example.org#@#.ad
+shop.example.net#?#div:-abp-has(.sponsored)
+0.0.0.0 hash.example # trailing comment
+||fragment.example^$domain=site.example#anchor
+[Adblock Plus 2.0]
+; RPZ format
+$ORIGIN rpz.local.
+$TTL 300
+@ SOA localhost. root.localhost. 1 3600 600 86400 300
+@ NS localhost.
+malware.test CNAME .
+*.phish.test CNAME .
+evil.example.rpz.local. 300 IN CNAME .
+nodata.test CNAME *.
+allowed.test CNAME rpz-passthru.
+garden.test CNAME walled.example.com.
+# plain format
+plain.example
+`
+
+func TestParse(t *testing.T) {
+	l, err := Parse("mixed", strings.NewReader(mixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"ads.example.com.":           "ads.example.com",
+		"x.ads.example.com":          "ads.example.com",
+		"TRACKER.example.net":        "tracker.example.net",
+		"stats.g.doubleclick.net":    "doubleclick.net",
+		"metrics.example.org":        "metrics.example.org",
+		"malware.test":               "malware.test",
+		"login.phish.test.":          "phish.test",
+		"evil.example":               "evil.example",
+		"nodata.test":                "nodata.test",
+		"allowed.test":               "",
+		"garden.test":                "",
+		"www.plain.example":          "plain.example",
+		"example.com":                "",
+		"notdoubleclick.net":         "",
+		"localhost":                  "",
+		"rpz.local":                  "",
+		"ip6-localhost":              "",
+		"safe.example.org":           "",
+		"www.example.com":            "",
+		"news.example.org":           "",
+		"shop.example.net":           "",
+		"hash.example":               "hash.example",
+		"fragment.example":           "fragment.example",
+		"ads.example.com.evil.local": "",
+	} {
+		got, ok := l.Match(name)
+		if ok != (want != "") || got != want {
+			t.Errorf("Match(%q) = %q, %v; want %q", name, got, ok, want)
+		}
+	}
+	if want, got := 11, l.Len(); want != got {
+		t.Errorf("Len() = %d; want %d", got, want)
+	}
+}
+
+func TestSet_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list")
+	if err := ioutil.WriteFile(path, []byte("one.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var s Set
+	if err := s.Load("test", path); err != nil {
+		t.Fatal(err)
+	}
+	if m := s.Match("www.one.example"); len(m) != 1 || m[0].List != "test" || m[0].Domain != "one.example" {
+		t.Errorf("Match(www.one.example) = %v", m)
+	}
+	if reloaded, errs := s.Reload(); len(reloaded) != 0 || len(errs) != 0 {
+		t.Errorf("Reload() of unchanged file = %v, %v", reloaded, errs)
+	}
+	if err := ioutil.WriteFile(path, []byte("two.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, errs := s.Reload(); len(reloaded) != 1 || len(errs) != 0 {
+		t.Errorf("Reload() of changed file = %v, %v", reloaded, errs)
+	}
+	if m := s.Match("one.example"); len(m) != 0 {
+		t.Errorf("Match(one.example) = %v after reload", m)
+	}
+	if m := s.Match("two.example"); len(m) != 1 {
+		t.Errorf("Match(two.example) = %v after reload", m)
+	}
+	os.Remove(path)
+	if _, errs := s.Reload(); len(errs) != 1 {
+		t.Errorf("Reload() of missing file returned %v", errs)
+	}
+	if m := s.Match("two.example"); len(m) != 1 {
+		t.Errorf("Match(two.example) = %v after failed reload", m)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/dichro/pubsub-logging/dnstap2mqtt/sniff"
+)
+
+var (
+	sniffIface    = flag.String("sniff_interface", "", "network interface to capture DNS traffic to and from port 53 on, for resolvers without dnstap support")
+	sniffFilter   = flag.String("sniff_filter", "", `BPF program to apply to captured packets, as printed by "tcpdump -ddd", with commas or newlines between instructions`)
+	sniffIdentity = flag.String("sniff_identity", "", "dnstap identity of messages synthesised from captured packets; defaults to the hostname")
+)
+
+// newSniffer returns a Sniffer configured from flags that sends frames to
+// out.
+func newSniffer(out chan<- []byte) (*sniff.Sniffer, error) {
+	filter, err := sniff.ParseFilter(*sniffFilter)
+	if err != nil {
+		return nil, err
+	}
+	id := *sniffIdentity
+	if id == "" {
+		if id, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	return sniff.New(id, filter, out)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/dichro/pubsub-logging/dnstap2mqtt/blocklist"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// DNSTap is a dnstap message with its DNS payload unpacked and its addresses
+// rendered as strings.
+type DNSTap struct {
+	SocketFamily   *dnstap.SocketFamily
+	SocketProtocol *dnstap.SocketProtocol
+	Message        dns.Msg
+	Timestamp      time.Time
+
+	// Identity and Version describe the server that sent the message.
+	Identity string
+	Version  string
+	// Type is the dnstap message type, such as CLIENT_QUERY or
+	// RESOLVER_RESPONSE.
+	Type            string
+	QueryAddress    string
+	QueryPort       uint32
+	ResponseAddress string
+	ResponsePort    uint32
+	// QueryZone is the zone a resolver was querying, for RESOLVER_* messages.
+	QueryZone string
+	// EDNS is the decoded OPT record of Message, if it has one.
+	EDNS *EDNS `json:",omitempty"`
+
+	// Blocklist lists the blocklist entries matching the query name or any
+	// name in the answer.
+	Blocklist []blocklist.Match `json:",omitempty"`
+	// Suspicion scores the message for signs of DNS tunnelling or
+	// generated domains, for the reasons given.
+	Suspicion        float64  `json:",omitempty"`
+	SuspicionReasons []string `json:",omitempty"`
+
+	// size is the length of the packed DNS message.
+	size int
+}
+
+// cook unpacks a dnstap message into a DNSTap. If that isn't possible, it
+// returns nil and the result label to count the message under, along with
+// the error, if any.
+func cook(msg *dnstap.Dnstap) (*DNSTap, string, error) {
+	m := msg.GetMessage()
+	if m == nil {
+		return nil, "type-unknown", nil
+	}
+	dt := &DNSTap{
+		SocketFamily:    m.SocketFamily,
+		SocketProtocol:  m.SocketProtocol,
+		Identity:        string(msg.GetIdentity()),
+		Version:         string(msg.GetVersion()),
+		Type:            m.GetType().String(),
+		QueryAddress:    ipString(m.GetQueryAddress()),
+		QueryPort:       m.GetQueryPort(),
+		ResponseAddress: ipString(m.GetResponseAddress()),
+		ResponsePort:    m.GetResponsePort(),
+	}
+	if zone := m.GetQueryZone(); len(zone) > 0 {
+		if name, _, err := dns.UnpackDomainName(zone, 0); err == nil {
+			dt.QueryZone = name
+		}
+	}
+	var msgBuf []byte
+	switch m.GetType() {
+	case dnstap.Message_AUTH_QUERY, dnstap.Message_CLIENT_QUERY, dnstap.Message_FORWARDER_QUERY,
+		dnstap.Message_RESOLVER_QUERY, dnstap.Message_STUB_QUERY, dnstap.Message_TOOL_QUERY:
+		msgBuf = m.GetQueryMessage()
+		dt.Timestamp = time.Unix(int64(m.GetQueryTimeSec()), int64(m.GetQueryTimeNsec()))
+	case dnstap.Message_AUTH_RESPONSE, dnstap.Message_CLIENT_RESPONSE, dnstap.Message_FORWARDER_RESPONSE,
+		dnstap.Message_RESOLVER_RESPONSE, dnstap.Message_STUB_RESPONSE, dnstap.Message_TOOL_RESPONSE:
+		msgBuf = m.GetResponseMessage()
+		dt.Timestamp = time.Unix(int64(m.GetResponseTimeSec()), int64(m.GetResponseTimeNsec()))
+	default:
+		return nil, "type-unknown", nil
+	}
+	if err := dt.Message.Unpack(msgBuf); err != nil {
+		return nil, "unpack-query", err
+	}
+	dt.size = len(msgBuf)
+	dt.EDNS = decodeEDNS(&dt.Message)
+	return dt, "", nil
+}
+
+// ipString renders a binary IPv4 or IPv6 address as a string, or returns
+// the empty string if b is neither.
+func ipString(b []byte) string {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return ""
+	}
+	return net.IP(b).String()
+}
@@ -1,4 +1,11 @@
 // This program receives dnstap messages and publishes them as JSON on an MQTT topic.
+//
+// Run as "dnstap2mqtt schema" to print the BigQuery table schema for the
+// messages published on --mqtt_topic_flat.
+//
+// Run as "dnstap2mqtt replay FILE..." to publish the messages in Frame Streams
+// capture files, such as those written by "dnstap -w", and exit. Packet
+// capture files in pcap or pcapng format are sniffed as for --sniff_interface.
 package main
 
 import (
@@ -8,24 +15,29 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/dichro/pubsub-logging/dnstap2mqtt/pdns"
 	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
 	dnstap "github.com/dnstap/golang-dnstap"
 	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
-	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	dnstapAddr  = flag.String("dnstap_listen", ":8000", "TCP address to listen for dnstap messages on")
+	dnstapAddr  = flag.String("dnstap_listen", ":8000", "TCP address to listen for dnstap messages on, or empty to disable")
+	dnstapSock  = flag.String("dnstap_socket", "", "path of unix socket to listen for dnstap messages on")
+	dnstapMode  = flag.String("dnstap_socket_mode", "0660", "permissions of the dnstap unix socket")
 	httpAddr    = flag.String("http_listen", ":8080", "address to listen on for http requests (addr:port)")
 	mqttAddr    = flag.String("mqtt_address", "tcp://mqtt:1883", "address of MQTT broker")
-	rawTopic    = flag.String("mqtt_topic_raw", "dnstap/raw/json", "MQTT topic to publish raw dnstap messages")
-	cookedTopic = flag.String("mqtt_topic_cooked", "dnstap/cooked/json", "MQTT topic to publish more useful dnstap messages")
+	rawTopic    = flag.String("mqtt_topic_raw", "dnstap/raw/json", "MQTT topic to publish raw dnstap messages, or empty to disable")
+	cookedTopic = flag.String("mqtt_topic_cooked", "dnstap/cooked/json", "MQTT topic to publish more useful dnstap messages, or empty to disable")
+	redactCfg   = flag.String("redact_config", "", "JSON file of redaction rules to apply before publishing")
 
 	messageCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: "dnstap",
@@ -41,12 +53,54 @@ func init() {
 func main() {
 	flag.Parse()
 	defer glog.Flush()
-	l, err := net.Listen("tcp", *dnstapAddr)
+	if flag.Arg(0) == "schema" {
+		if err := printSchema(os.Stdout); err != nil {
+			glog.Exit(err)
+		}
+		return
+	}
+	r, err := redact.Load(*redactCfg)
+	if err != nil {
+		glog.Exit(err)
+	}
+	anon, err := newAnonymiser(*anonMode, *anonV4, *anonV6, *anonKey, *anonRotate)
 	if err != nil {
 		glog.Exit(err)
 	}
 	ch := make(chan []byte)
-	go dnstap.NewFrameStreamSockInput(l).ReadInto(ch)
+	replaying := flag.Arg(0) == "replay"
+	if replaying {
+		go func() {
+			if err := replay(flag.Args()[1:], *replaySpeed, ch); err != nil {
+				glog.Exit(err)
+			}
+			close(ch)
+		}()
+	} else {
+		if len(*dnstapAddr) > 0 {
+			l, err := net.Listen("tcp", *dnstapAddr)
+			if err != nil {
+				glog.Exit(err)
+			}
+			go serve(l, ch)
+		}
+		if len(*dnstapSock) > 0 {
+			l, err := listenUnix(*dnstapSock, *dnstapMode)
+			if err != nil {
+				glog.Exit(err)
+			}
+			go serve(l, ch)
+		}
+		if len(*sniffIface) > 0 {
+			s, err := newSniffer(ch)
+			if err != nil {
+				glog.Exit(err)
+			}
+			go func() {
+				glog.Exit(s.Live(*sniffIface))
+			}()
+		}
+	}
 
 	opts := paho.NewClientOptions()
 	opts.AddBroker(*mqttAddr)
@@ -56,20 +110,98 @@ func main() {
 		glog.Fatal(token.Error())
 	}
 
-	go decode(pub.New(mqtt, 1, false), ch)
+	p := pub.New(mqtt, 1, false)
+	if replaying {
+		if *replayInflight <= 0 {
+			glog.Exit("--replay_max_inflight must be positive")
+		}
+		p.Limit(*replayInflight)
+	}
+	messageTime = replaying
+	// stages that annotate messages must come before those that consume them
+	var stages []stage
+	if len(blocklists) > 0 {
+		t, err := newTagger(p, r, blocklists)
+		if err != nil {
+			glog.Exit(err)
+		}
+		go t.watch(*blocklistCheck)
+		stages = append(stages, t)
+	}
+	if *suspicion {
+		stages = append(stages, newScorer(p, r, *suspicionWindow, *suspicionMaxTracks))
+	}
+	if len(*pairedTopic) > 0 {
+		if *pairMax <= 0 {
+			glog.Exit("--pair_max_outstanding must be positive")
+		}
+		pr := newPairer(p, r, *pairTimeout, *pairMax)
+		if !replaying {
+			go pr.run()
+		}
+		stages = append(stages, pr)
+	}
+	if *summaryInterval > 0 {
+		sum := newSummariser(p, r, *summaryInterval, *summaryTop, *summaryCapacity)
+		if !replaying {
+			go sum.run()
+		}
+		stages = append(stages, sum)
+	}
+	if *newDomains {
+		d := newDetector(p, r, *newDomainState)
+		if !replaying {
+			go d.run()
+		}
+		stages = append(stages, d)
+	}
+	if *dnsMetrics {
+		stages = append(stages, newMetrics(*maxIdentities))
+	}
+	if len(*pdnsDB) > 0 {
+		store, err := pdns.Open(*pdnsDB)
+		if err != nil {
+			glog.Exit(err)
+		}
+		rec := &recorder{store: store}
+		go rec.run(*pdnsFlush)
+		stages = append(stages, rec)
+		http.Handle("/pdns/", pdns.Handler(store))
+	}
+	if len(*flatTopic) > 0 {
+		stages = append(stages, &flattener{pub: p, redact: r})
+	}
+	if replaying {
+		decode(p, r, anon, stages, ch)
+		for _, s := range stages {
+			if f, ok := s.(flusher); ok {
+				f.flush()
+			}
+		}
+		p.Wait()
+		return
+	}
+	go decode(p, r, anon, stages, ch)
 	http.Handle("/metrics", promhttp.Handler())
 	glog.Fatal(http.ListenAndServe(*httpAddr, nil))
 }
 
-type DNSTap struct {
-	SocketFamily   *dnstap.SocketFamily
-	SocketProtocol *dnstap.SocketProtocol
-	Message        dns.Msg
-	Timestamp      time.Time
+// A stage consumes cooked dnstap messages before they are published, and may
+// annotate them.
+type stage interface {
+	process(dt *DNSTap)
+}
+
+// encode returns v as redacted JSON.
+func encode(r *redact.Redactor, v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return r.JSON(buf.Bytes())
 }
 
-func decode(p *pub.Publisher, ch <-chan []byte) {
-	defer glog.Exit("done")
+func decode(p *pub.Publisher, r *redact.Redactor, anon *anonymiser, stages []stage, ch <-chan []byte) {
 	for buf := range ch {
 		var msg dnstap.Dnstap
 		if err := proto.Unmarshal(buf, &msg); err != nil {
@@ -77,6 +209,20 @@ func decode(p *pub.Publisher, ch <-chan []byte) {
 			messageCount.WithLabelValues("unmarshal").Inc()
 			continue
 		}
+		dt, result, err := cook(&msg)
+		if dt != nil && len(*fullTopic) > 0 {
+			if out, err := encode(r, dt); err != nil {
+				glog.Error(err)
+			} else {
+				p.Go(*fullTopic, out)
+			}
+		}
+		// stages see the real query address; only the raw and cooked
+		// topics are anonymised
+		var addr string
+		if anon != nil {
+			addr = anon.anonymise(msg.Message)
+		}
 		if len(*rawTopic) > 0 {
 			var buf bytes.Buffer
 			if err := json.NewEncoder(&buf).Encode(msg); err != nil {
@@ -84,39 +230,46 @@ func decode(p *pub.Publisher, ch <-chan []byte) {
 				glog.Error(err)
 				continue
 			}
-			go p.Publish(*rawTopic, buf.Bytes())
-		}
-		dt := DNSTap{
-			SocketFamily:   msg.Message.SocketFamily,
-			SocketProtocol: msg.Message.SocketProtocol,
-		}
-		var msgBuf []byte
-		switch msg.Message.GetType() {
-		case dnstap.Message_AUTH_QUERY, dnstap.Message_CLIENT_QUERY, dnstap.Message_FORWARDER_QUERY,
-			dnstap.Message_RESOLVER_QUERY, dnstap.Message_STUB_QUERY, dnstap.Message_TOOL_QUERY:
-			msgBuf = msg.Message.GetQueryMessage()
-			dt.Timestamp = time.Unix(int64(msg.Message.GetQueryTimeSec()), int64(msg.Message.GetQueryTimeNsec()))
-		case dnstap.Message_AUTH_RESPONSE, dnstap.Message_CLIENT_RESPONSE, dnstap.Message_FORWARDER_RESPONSE,
-			dnstap.Message_RESOLVER_RESPONSE, dnstap.Message_STUB_RESPONSE, dnstap.Message_TOOL_RESPONSE:
-			msgBuf = msg.Message.GetResponseMessage()
-			dt.Timestamp = time.Unix(int64(msg.Message.GetResponseTimeSec()), int64(msg.Message.GetResponseTimeNsec()))
-		default:
-			messageCount.WithLabelValues("type-unknown").Inc()
-			continue
+			out, err := r.JSON(buf.Bytes())
+			if err != nil {
+				messageCount.WithLabelValues("redact-raw").Inc()
+				glog.Error(err)
+				continue
+			}
+			p.Go(*rawTopic, out)
 		}
-
-		if err := dt.Message.Unpack(msgBuf); err != nil {
-			glog.Error(err)
-			messageCount.WithLabelValues("unpack-query").Inc()
+		if dt == nil {
+			if err != nil {
+				glog.Error(err)
+			}
+			messageCount.WithLabelValues(result).Inc()
 			continue
 		}
-		var buf bytes.Buffer
-		if err := json.NewEncoder(&buf).Encode(dt); err != nil {
-			glog.Error(err)
-			messageCount.WithLabelValues("encode-cooked").Inc()
-			continue
+		for _, s := range stages {
+			s.process(dt)
+		}
+		if len(*cookedTopic) > 0 {
+			cooked := dt
+			if anon != nil {
+				// stages may still hold dt
+				c := *dt
+				c.QueryAddress = addr
+				cooked = &c
+			}
+			var buf bytes.Buffer
+			if err := json.NewEncoder(&buf).Encode(cooked); err != nil {
+				glog.Error(err)
+				messageCount.WithLabelValues("encode-cooked").Inc()
+				continue
+			}
+			out, err := r.JSON(buf.Bytes())
+			if err != nil {
+				glog.Error(err)
+				messageCount.WithLabelValues("redact-cooked").Inc()
+				continue
+			}
+			p.Go(*cookedTopic, out)
 		}
-		go p.Publish(*cookedTopic, buf.Bytes())
 		if glog.V(1) {
 			fmt.Println(time.Now())
 			fmt.Printf("%#v\n", msg)
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// EDNS is the decoded OPT pseudo-record of a DNS message.
+type EDNS struct {
+	Version uint8
+	UDPSize uint16
+	// DO is set if the sender wants DNSSEC records.
+	DO           bool
+	ClientSubnet *ClientSubnet `json:",omitempty"`
+	// Cookie is set if the message carried a DNS cookie; ServerCookie is set
+	// if that included a server cookie as well as a client cookie.
+	Cookie         bool
+	ServerCookie   bool
+	ExtendedErrors []ExtendedError `json:",omitempty"`
+	// Padding is the number of bytes of padding, or 0 if there was none.
+	Padding int
+	// Options lists the codes of all EDNS0 options present.
+	Options []uint16
+}
+
+// ClientSubnet is an EDNS Client Subnet option.
+type ClientSubnet struct {
+	// Family is 1 for IPv4 or 2 for IPv6.
+	Family       uint16
+	SourcePrefix uint8
+	ScopePrefix  uint8
+	Address      string
+}
+
+// ExtendedError is an Extended DNS Error option.
+type ExtendedError struct {
+	Code uint16
+	Name string
+	Text string
+}
+
+// decodeEDNS decodes the OPT record of m, or returns nil if it has none.
+func decodeEDNS(m *dns.Msg) *EDNS {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	e := &EDNS{
+		Version: opt.Version(),
+		UDPSize: opt.UDPSize(),
+		DO:      opt.Do(),
+		Options: make([]uint16, 0, len(opt.Option)),
+	}
+	for _, o := range opt.Option {
+		e.Options = append(e.Options, o.Option())
+		switch o := o.(type) {
+		case *dns.EDNS0_SUBNET:
+			cs := &ClientSubnet{
+				Family:       o.Family,
+				SourcePrefix: o.SourceNetmask,
+				ScopePrefix:  o.SourceScope,
+			}
+			if o.Address != nil {
+				cs.Address = o.Address.String()
+			}
+			e.ClientSubnet = cs
+		case *dns.EDNS0_COOKIE:
+			// hex-encoded: an 8-byte client cookie, optionally followed by
+			// an 8 to 32 byte server cookie
+			e.Cookie = true
+			e.ServerCookie = len(o.Cookie) > 16
+		case *dns.EDNS0_EDE:
+			e.ExtendedErrors = append(e.ExtendedErrors, ExtendedError{
+				Code: o.InfoCode,
+				Name: dns.ExtendedErrorCodeToString[o.InfoCode],
+				Text: o.ExtraText,
+			})
+		case *dns.EDNS0_PADDING:
+			e.Padding = len(o.Padding)
+		}
+	}
+	return e
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDecodeEDNS(t *testing.T) {
+	var m dns.Msg
+	if decodeEDNS(&m) != nil {
+		t.Error("decodeEDNS() of message without OPT != nil")
+	}
+	m.SetEdns0(1232, true)
+	opt := m.IsEdns0()
+	opt.Option = []dns.EDNS0{
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.168.8.0").To4()},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "24a5ac2bf8d9d1cb0102030405060708"},
+		&dns.EDNS0_EDE{InfoCode: 15, ExtraText: "ads.example"},
+		&dns.EDNS0_PADDING{Padding: make([]byte, 128)},
+	}
+
+	e := decodeEDNS(&m)
+	if e == nil {
+		t.Fatal("decodeEDNS() = nil")
+	}
+	if e.UDPSize != 1232 || !e.DO || e.Version != 0 {
+		t.Errorf("header = size:%d do:%v version:%d; want 1232, true, 0", e.UDPSize, e.DO, e.Version)
+	}
+	if want, got := (&ClientSubnet{Family: 1, SourcePrefix: 24, Address: "192.168.8.0"}), e.ClientSubnet; !reflect.DeepEqual(want, got) {
+		t.Errorf("ClientSubnet = %+v; want %+v", got, want)
+	}
+	if !e.Cookie || !e.ServerCookie {
+		t.Errorf("cookie = %v, server %v; want both", e.Cookie, e.ServerCookie)
+	}
+	if want, got := []ExtendedError{{Code: 15, Name: "Blocked", Text: "ads.example"}}, e.ExtendedErrors; !reflect.DeepEqual(want, got) {
+		t.Errorf("ExtendedErrors = %+v; want %+v", got, want)
+	}
+	if e.Padding != 128 {
+		t.Errorf("Padding = %d; want 128", e.Padding)
+	}
+	if want, got := []uint16{dns.EDNS0SUBNET, dns.EDNS0COOKIE, dns.EDNS0EDE, dns.EDNS0PADDING}, e.Options; !reflect.DeepEqual(want, got) {
+		t.Errorf("Options = %v; want %v", got, want)
+	}
+
+	f := flatten(&DNSTap{EDNS: e})
+	if !f.EDNS || f.ECSAddress != "192.168.8.0" || f.ECSSourcePrefix != 24 {
+		t.Errorf("flattened ECS = %v %q/%d", f.EDNS, f.ECSAddress, f.ECSSourcePrefix)
+	}
+	if want, got := []string{"Blocked"}, f.EDENames; !reflect.DeepEqual(want, got) {
+		t.Errorf("EDENames = %v; want %v", got, want)
+	}
+}
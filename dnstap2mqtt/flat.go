@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+var flatTopic = flag.String("mqtt_topic_flat", "", "MQTT topic to publish flattened dnstap messages, or empty to disable")
+
+// Flat is a DNSTap flattened into a stable schema that maps directly onto a
+// BigQuery table. "dnstap2mqtt schema" prints the matching table schema.
+// Repeated fields are always present, even if empty.
+type Flat struct {
+	Timestamp       time.Time `json:"timestamp"`
+	Identity        string    `json:"identity"`
+	Version         string    `json:"version"`
+	Type            string    `json:"type"`
+	SocketFamily    string    `json:"socket_family"`
+	SocketProtocol  string    `json:"socket_protocol"`
+	QueryAddress    string    `json:"query_address"`
+	QueryPort       uint32    `json:"query_port"`
+	ResponseAddress string    `json:"response_address"`
+	ResponsePort    uint32    `json:"response_port"`
+	QueryZone       string    `json:"query_zone"`
+
+	ID     uint16 `json:"id"`
+	Opcode string `json:"opcode"`
+	Rcode  string `json:"rcode"`
+	QR     bool   `json:"qr"`
+	AA     bool   `json:"aa"`
+	TC     bool   `json:"tc"`
+	RD     bool   `json:"rd"`
+	RA     bool   `json:"ra"`
+	AD     bool   `json:"ad"`
+	CD     bool   `json:"cd"`
+
+	QName  string `json:"qname"`
+	QType  string `json:"qtype"`
+	QClass string `json:"qclass"`
+
+	AnswerCount     int      `json:"answer_count"`
+	AuthorityCount  int      `json:"authority_count"`
+	AdditionalCount int      `json:"additional_count"`
+	Answers         []string `json:"answers"`
+	AnswerTypes     []string `json:"answer_types"`
+	AnswerTTLs      []uint32 `json:"answer_ttls"`
+	AnswerIPs       []string `json:"answer_ips"`
+
+	EDNS            bool     `json:"edns"`
+	EDNSVersion     uint8    `json:"edns_version"`
+	EDNSUDPSize     uint16   `json:"edns_udp_size"`
+	EDNSDO          bool     `json:"edns_do"`
+	EDNSCookie      bool     `json:"edns_cookie"`
+	EDNSPadding     int      `json:"edns_padding"`
+	ECSFamily       uint16   `json:"ecs_family"`
+	ECSSourcePrefix uint8    `json:"ecs_source_prefix"`
+	ECSScopePrefix  uint8    `json:"ecs_scope_prefix"`
+	ECSAddress      string   `json:"ecs_address"`
+	EDECodes        []uint16 `json:"ede_codes"`
+	EDENames        []string `json:"ede_names"`
+	EDETexts        []string `json:"ede_texts"`
+
+	Blocklists     []string `json:"blocklists"`
+	BlockedDomains []string `json:"blocked_domains"`
+
+	Suspicion        float64  `json:"suspicion"`
+	SuspicionReasons []string `json:"suspicion_reasons"`
+}
+
+// flatten converts dt into a Flat.
+func flatten(dt *DNSTap) *Flat {
+	m := &dt.Message
+	f := &Flat{
+		Timestamp:        dt.Timestamp,
+		Identity:         dt.Identity,
+		Version:          dt.Version,
+		Type:             dt.Type,
+		QueryAddress:     dt.QueryAddress,
+		QueryPort:        dt.QueryPort,
+		ResponseAddress:  dt.ResponseAddress,
+		ResponsePort:     dt.ResponsePort,
+		QueryZone:        dt.QueryZone,
+		ID:               m.Id,
+		Opcode:           opcodeName(m.Opcode),
+		Rcode:            rcodeName(m.Rcode),
+		QR:               m.Response,
+		AA:               m.Authoritative,
+		TC:               m.Truncated,
+		RD:               m.RecursionDesired,
+		RA:               m.RecursionAvailable,
+		AD:               m.AuthenticatedData,
+		CD:               m.CheckingDisabled,
+		AnswerCount:      len(m.Answer),
+		AuthorityCount:   len(m.Ns),
+		AdditionalCount:  len(m.Extra),
+		Answers:          make([]string, 0, len(m.Answer)),
+		AnswerTypes:      make([]string, 0, len(m.Answer)),
+		AnswerTTLs:       make([]uint32, 0, len(m.Answer)),
+		AnswerIPs:        []string{},
+		Blocklists:       make([]string, 0, len(dt.Blocklist)),
+		BlockedDomains:   make([]string, 0, len(dt.Blocklist)),
+		EDECodes:         []uint16{},
+		EDENames:         []string{},
+		EDETexts:         []string{},
+		Suspicion:        dt.Suspicion,
+		SuspicionReasons: append([]string{}, dt.SuspicionReasons...),
+	}
+	if dt.SocketFamily != nil {
+		f.SocketFamily = dt.SocketFamily.String()
+	}
+	if dt.SocketProtocol != nil {
+		f.SocketProtocol = dt.SocketProtocol.String()
+	}
+	if len(m.Question) > 0 {
+		q := m.Question[0]
+		f.QName = strings.ToLower(q.Name)
+		f.QType = typeName(q.Qtype)
+		f.QClass = className(q.Qclass)
+	}
+	for _, rr := range m.Answer {
+		h := rr.Header()
+		f.Answers = append(f.Answers, rdata(rr))
+		f.AnswerTypes = append(f.AnswerTypes, typeName(h.Rrtype))
+		f.AnswerTTLs = append(f.AnswerTTLs, h.Ttl)
+		if ip := answerIP(rr); ip != nil {
+			f.AnswerIPs = append(f.AnswerIPs, ip.String())
+		}
+	}
+	if e := dt.EDNS; e != nil {
+		f.EDNS = true
+		f.EDNSVersion = e.Version
+		f.EDNSUDPSize = e.UDPSize
+		f.EDNSDO = e.DO
+		f.EDNSCookie = e.Cookie
+		f.EDNSPadding = e.Padding
+		if cs := e.ClientSubnet; cs != nil {
+			f.ECSFamily = cs.Family
+			f.ECSSourcePrefix = cs.SourcePrefix
+			f.ECSScopePrefix = cs.ScopePrefix
+			f.ECSAddress = cs.Address
+		}
+		for _, ede := range e.ExtendedErrors {
+			f.EDECodes = append(f.EDECodes, ede.Code)
+			f.EDENames = append(f.EDENames, ede.Name)
+			f.EDETexts = append(f.EDETexts, ede.Text)
+		}
+	}
+	for _, b := range dt.Blocklist {
+		f.Blocklists = append(f.Blocklists, b.List)
+		f.BlockedDomains = append(f.BlockedDomains, b.Domain)
+	}
+	return f
+}
+
+// rdata returns the presentation form of rr's data, without its header.
+func rdata(rr dns.RR) string {
+	s := rr.String()
+	hdr := rr.Header().String()
+	if strings.HasPrefix(s, hdr) {
+		return s[len(hdr):]
+	}
+	return s
+}
+
+// answerIP returns the address in an A or AAAA record, or nil for any other
+// record.
+func answerIP(rr dns.RR) net.IP {
+	switch a := rr.(type) {
+	case *dns.A:
+		return a.A
+	case *dns.AAAA:
+		return a.AAAA
+	}
+	return nil
+}
+
+func className(c uint16) string {
+	if s, ok := dns.ClassToString[c]; ok {
+		return s
+	}
+	return fmt.Sprint(c)
+}
+
+func opcodeName(op int) string {
+	if s, ok := dns.OpcodeToString[op]; ok {
+		return s
+	}
+	return fmt.Sprint(op)
+}
+
+// flattener publishes flattened messages.
+type flattener struct {
+	pub    *pub.Publisher
+	redact *redact.Redactor
+}
+
+func (f *flattener) process(dt *DNSTap) {
+	out, err := encode(f.redact, flatten(dt))
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	f.pub.Go(*flatTopic, out)
+}
+
+// SchemaField is a column in a BigQuery table schema, in the JSON form
+// accepted by "bq mk --schema".
+type SchemaField struct {
+	Name   string        `json:"name"`
+	Type   string        `json:"type"`
+	Mode   string        `json:"mode"`
+	Fields []SchemaField `json:"fields,omitempty"`
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the BigQuery schema matching the JSON encoding of t, which
+// must be a struct type.
+func schema(t reflect.Type) []SchemaField {
+	var fields []SchemaField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "-" || sf.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		f := SchemaField{Name: name, Mode: "NULLABLE"}
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Slice && ft.Elem().Kind() != reflect.Uint8 {
+			f.Mode = "REPEATED"
+			ft = ft.Elem()
+		}
+		switch {
+		case ft == timeType:
+			f.Type = "TIMESTAMP"
+		case ft.Kind() == reflect.String:
+			f.Type = "STRING"
+		case ft.Kind() == reflect.Bool:
+			f.Type = "BOOLEAN"
+		case ft.Kind() >= reflect.Int && ft.Kind() <= reflect.Uint64:
+			f.Type = "INTEGER"
+		case ft.Kind() == reflect.Float32 || ft.Kind() == reflect.Float64:
+			f.Type = "FLOAT"
+		case ft.Kind() == reflect.Slice:
+			f.Type = "BYTES"
+		case ft.Kind() == reflect.Struct:
+			f.Type = "RECORD"
+			f.Fields = schema(ft)
+		default:
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// printSchema writes the BigQuery schema for flattened messages to w.
+func printSchema(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(schema(reflect.TypeOf(Flat{})))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFlatten(t *testing.T) {
+	dt := &DNSTap{
+		Type:         "CLIENT_RESPONSE",
+		QueryAddress: "192.168.8.68",
+		QueryPort:    5353,
+		Timestamp:    time.Unix(1581969154, 0),
+	}
+	dt.Message.Id = 10809
+	dt.Message.Response = true
+	dt.Message.RecursionDesired = true
+	dt.Message.Question = []dns.Question{{Name: "www.PurpleAir.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+	dt.Message.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "www.purpleair.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("104.21.1.1"),
+	}}
+
+	f := flatten(dt)
+	if want, got := "www.purpleair.com.", f.QName; want != got {
+		t.Errorf("QName = %q; want %q", got, want)
+	}
+	if !f.QR || !f.RD || f.AA {
+		t.Errorf("flags = qr:%v rd:%v aa:%v; want qr, rd only", f.QR, f.RD, f.AA)
+	}
+	if want, got := []string{"104.21.1.1"}, f.AnswerIPs; !reflect.DeepEqual(want, got) {
+		t.Errorf("AnswerIPs = %v; want %v", got, want)
+	}
+	if want, got := []string{"104.21.1.1"}, f.Answers; !reflect.DeepEqual(want, got) {
+		t.Errorf("Answers = %v; want %v", got, want)
+	}
+	if want, got := []uint32{300}, f.AnswerTTLs; !reflect.DeepEqual(want, got) {
+		t.Errorf("AnswerTTLs = %v; want %v", got, want)
+	}
+}
+
+// TestSchema checks that every key in a flattened message has a column in
+// the schema, and that no repeated column is ever encoded as null.
+func TestSchema(t *testing.T) {
+	columns := make(map[string]SchemaField)
+	for _, f := range schema(reflect.TypeOf(Flat{})) {
+		columns[f.Name] = f
+	}
+	b, err := json.Marshal(flatten(&DNSTap{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make(map[string]interface{})
+	if err := json.Unmarshal(b, &msg); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range msg {
+		c, ok := columns[k]
+		if !ok {
+			t.Errorf("no column for key %q", k)
+			continue
+		}
+		if c.Mode == "REPEATED" && v == nil {
+			t.Errorf("repeated column %q encoded as null", k)
+		}
+		delete(columns, k)
+	}
+	for k := range columns {
+		t.Errorf("no key for column %q", k)
+	}
+}
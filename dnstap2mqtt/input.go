@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connectionCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "dnstap",
+		Name:      "connections",
+		Help:      "count of open dnstap connections",
+	}, []string{"listener"})
+	frameCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dnstap",
+		Name:      "frames",
+		Help:      "count of dnstap frames received, by sender identity",
+	}, []string{"identity"})
+
+	connectionID uint64
+)
+
+func init() {
+	prometheus.MustRegister(connectionCount)
+	prometheus.MustRegister(frameCount)
+}
+
+// listenUnix listens on a unix stream socket at path, replacing any stale
+// socket left behind by a previous run, and sets its permissions to mode
+// (an octal string, as for chmod).
+func listenUnix(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serve accepts bidirectional Frame Streams connections on l and forwards
+// the frames from each one to ch.
+func serve(l net.Listener, ch chan<- []byte) {
+	listener := l.Addr().String()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				glog.Error(err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			glog.Exit(err)
+		}
+		go handle(listener, conn, ch)
+	}
+}
+
+// handle reads frames from a single writer until it disconnects.
+func handle(listener string, conn net.Conn, out chan<- []byte) {
+	defer conn.Close()
+	name := connName(listener, conn)
+	in, err := dnstap.NewFrameStreamInput(conn, true)
+	if err != nil {
+		glog.Errorf("%s: handshake failed: %v", name, err)
+		return
+	}
+	glog.Infof("%s: connected", name)
+	connectionCount.WithLabelValues(listener).Inc()
+	defer connectionCount.WithLabelValues(listener).Dec()
+
+	ch := make(chan []byte)
+	go func() {
+		in.ReadInto(ch)
+		close(ch)
+	}()
+	start := time.Now()
+	var frames prometheus.Counter
+	n := 0
+	for buf := range ch {
+		if frames == nil {
+			id := identity(buf, conn)
+			glog.Infof("%s: sender identifies as %q", name, id)
+			frames = frameCount.WithLabelValues(id)
+		}
+		frames.Inc()
+		n++
+		out <- buf
+	}
+	glog.Infof("%s: disconnected after %d frames in %s", name, n, time.Since(start))
+}
+
+// connName returns a name for conn that is unique for the life of the
+// process, for logging.
+func connName(listener string, conn net.Conn) string {
+	id := atomic.AddUint64(&connectionID, 1)
+	if ra := conn.RemoteAddr(); ra != nil && ra.String() != "" && ra.String() != "@" {
+		return listener + "<-" + ra.String() + "#" + strconv.FormatUint(id, 10)
+	}
+	return listener + "#" + strconv.FormatUint(id, 10)
+}
+
+// identity returns the dnstap identity of the sender of the first frame on a
+// connection, falling back to the remote host or socket path.
+func identity(buf []byte, conn net.Conn) string {
+	var msg dnstap.Dnstap
+	if err := proto.Unmarshal(buf, &msg); err == nil && len(msg.GetIdentity()) > 0 {
+		return string(msg.GetIdentity())
+	}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		return host
+	}
+	return conn.LocalAddr().String()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dnsMetrics    = flag.Bool("dns_metrics", false, "export Prometheus metrics derived from the content of dnstap messages")
+	maxIdentities = flag.Int("dns_metrics_max_identities", 20, "maximum number of distinct sender identities to label DNS metrics with; others are labelled \"other\"")
+
+	queryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dnstap",
+		Name:      "client_queries",
+		Help:      "count of CLIENT_QUERY messages, by query type",
+	}, []string{"identity", "qtype"})
+	responseCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dnstap",
+		Name:      "client_responses",
+		Help:      "count of CLIENT_RESPONSE messages, by response code",
+	}, []string{"identity", "rcode"})
+	responseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "dnstap",
+		Name:      "client_response_bytes",
+		Help:      "size of CLIENT_RESPONSE messages",
+		Buckets:   prometheus.ExponentialBuckets(32, 2, 10),
+	}, []string{"identity"})
+	resolverQueryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dnstap",
+		Name:      "resolver_queries",
+		Help:      "count of RESOLVER_QUERY messages, that is, cache misses",
+	}, []string{"identity"})
+	flagCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dnstap",
+		Name:      "client_response_flags",
+		Help:      "count of CLIENT_RESPONSE messages with the TC or AD flag set",
+	}, []string{"identity", "flag"})
+)
+
+// metrics exports Prometheus metrics about the DNS messages in dnstap
+// messages.
+type metrics struct {
+	identities *limiter
+	qtypes     *limiter
+}
+
+func newMetrics(maxIdentities int) *metrics {
+	prometheus.MustRegister(queryCount)
+	prometheus.MustRegister(responseCount)
+	prometheus.MustRegister(responseSize)
+	prometheus.MustRegister(resolverQueryCount)
+	prometheus.MustRegister(flagCount)
+	return &metrics{
+		identities: newLimiter(maxIdentities),
+		qtypes:     newLimiter(len(dns.TypeToString)),
+	}
+}
+
+func (m *metrics) process(dt *DNSTap) {
+	id := m.identities.label(dt.Identity)
+	switch dt.Type {
+	case "CLIENT_QUERY":
+		qtype := "none"
+		if len(dt.Message.Question) > 0 {
+			qtype = m.qtypes.label(typeName(dt.Message.Question[0].Qtype))
+		}
+		queryCount.WithLabelValues(id, qtype).Inc()
+	case "CLIENT_RESPONSE":
+		// there are only 4096 possible rcodes, and few in use
+		responseCount.WithLabelValues(id, rcodeName(dt.Message.Rcode)).Inc()
+		responseSize.WithLabelValues(id).Observe(float64(dt.size))
+		if dt.Message.Truncated {
+			flagCount.WithLabelValues(id, "tc").Inc()
+		}
+		if dt.Message.AuthenticatedData {
+			flagCount.WithLabelValues(id, "ad").Inc()
+		}
+	case "RESOLVER_QUERY":
+		resolverQueryCount.WithLabelValues(id).Inc()
+	}
+}
+
+// limiter bounds the cardinality of a label by passing through only the
+// first max distinct values it sees, and replacing the rest with "other".
+type limiter struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]bool
+}
+
+func newLimiter(max int) *limiter {
+	return &limiter{max: max, seen: make(map[string]bool)}
+}
+
+func (l *limiter) label(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen[v] {
+		return v
+	}
+	if len(l.seen) >= l.max {
+		return "other"
+	}
+	l.seen[v] = true
+	return v
+}
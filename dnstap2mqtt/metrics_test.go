@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics(2)
+	t.Cleanup(func() {
+		queryCount.Reset()
+		responseCount.Reset()
+		responseSize.Reset()
+		flagCount.Reset()
+	})
+	for _, id := range []string{"ns1", "ns2", "ns3", "ns4", "ns1"} {
+		dt := clientMsg("CLIENT_QUERY", 5353, 1, time.Now())
+		dt.Identity = id
+		m.process(dt)
+	}
+	for id, want := range map[string]float64{"ns1": 2, "ns2": 1, "other": 2} {
+		if got := testutil.ToFloat64(queryCount.WithLabelValues(id, "A")); got != want {
+			t.Errorf("queries from %s = %v; want %v", id, got, want)
+		}
+	}
+	if got := testutil.CollectAndCount(queryCount); got != 3 {
+		t.Errorf("exported %d query series; want 3", got)
+	}
+
+	resp := clientMsg("CLIENT_RESPONSE", 5353, 1, time.Now())
+	resp.Identity = "ns3"
+	resp.Message.Rcode = dns.RcodeNameError
+	resp.Message.Truncated = true
+	m.process(resp)
+	if got := testutil.ToFloat64(responseCount.WithLabelValues("other", "NXDOMAIN")); got != 1 {
+		t.Errorf("NXDOMAIN responses from other = %v; want 1", got)
+	}
+	if got := testutil.ToFloat64(flagCount.WithLabelValues("other", "tc")); got != 1 {
+		t.Errorf("truncated responses from other = %v; want 1", got)
+	}
+}
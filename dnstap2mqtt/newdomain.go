@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dichro/pubsub-logging/dnstap2mqtt/seen"
+	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/publicsuffix"
+)
+
+var (
+	newDomains      = flag.Bool("new_domains", false, "publish the first successful resolution of each registered domain by any client")
+	newDomainTopic  = flag.String("mqtt_topic_new_domain", "dnstap/new_domain", "MQTT topic to publish newly observed domains")
+	newDomainState  = flag.String("new_domain_state", "", "file to persist newly observed domain state in across restarts")
+	newDomainCap    = flag.Int("new_domain_capacity", 250000, "number of registered domains to remember per generation")
+	newDomainGens   = flag.Int("new_domain_generations", 30, "number of generations to remember registered domains for")
+	newDomainRotate = flag.Duration("new_domain_generation", 24*time.Hour, "length of a generation")
+	newDomainLearn  = flag.Duration("new_domain_learn", 24*time.Hour, "how long to learn domains without publishing them when starting without saved state")
+	newDomainSave   = flag.Duration("new_domain_save", 5*time.Minute, "how often to save newly observed domain state")
+
+	newDomainCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dnstap",
+		Name:      "new_domains",
+		Help:      "count of newly observed registered domains",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(newDomainCount)
+}
+
+// newDomainFPRate is the rate at which new domains are mistaken for ones
+// already seen.
+const newDomainFPRate = 0.001
+
+// NewDomain records the first time any client resolved a registered domain.
+type NewDomain struct {
+	Domain    string    `json:"domain"`
+	QName     string    `json:"qname"`
+	Client    string    `json:"client"`
+	Identity  string    `json:"identity"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// detector publishes NewDomains for CLIENT_RESPONSE messages resolving
+// registered domains not seen before.
+type detector struct {
+	pub    *pub.Publisher
+	redact *redact.Redactor
+	path   string
+	seen   *seen.Filter
+	// learn is when to stop learning. In message time, it is set from
+	// learnFor by the first message.
+	learn    time.Time
+	learnFor time.Duration
+	// rotated is when the filter was last rotated in message time.
+	rotated time.Time
+}
+
+func newDetector(p *pub.Publisher, r *redact.Redactor, path string) *detector {
+	d := &detector{pub: p, redact: r, path: path}
+	if path != "" {
+		f, err := seen.Load(path)
+		switch {
+		case err == nil && !f.Fits(*newDomainCap, newDomainFPRate, *newDomainGens):
+			glog.Warningf("discarding newly observed domain state from %s: sized for different --new_domain_capacity or --new_domain_generations", path)
+		case err == nil:
+			glog.Infof("loaded newly observed domain state from %s", path)
+			d.seen = f
+			return d
+		case !os.IsNotExist(err):
+			glog.Errorf("discarding newly observed domain state: %v", err)
+		}
+	}
+	d.seen = seen.New(*newDomainCap, newDomainFPRate, *newDomainGens)
+	if messageTime {
+		d.learnFor = *newDomainLearn
+		glog.Infof("learning domains for %s from the first message", d.learnFor)
+		return d
+	}
+	d.learn = time.Now().Add(*newDomainLearn)
+	glog.Infof("learning domains until %s", d.learn)
+	return d
+}
+
+func (d *detector) process(dt *DNSTap) {
+	if dt.Type != "CLIENT_RESPONSE" || dt.Message.Rcode != dns.RcodeSuccess || len(dt.Message.Question) == 0 {
+		return
+	}
+	now := timeOf(dt)
+	if messageTime {
+		d.advance(now)
+	}
+	qname := strings.ToLower(dt.Message.Question[0].Name)
+	domain := registeredDomain(qname)
+	if domain == "" || d.seen.Seen(domain) {
+		return
+	}
+	if now.Before(d.learn) {
+		newDomainCount.WithLabelValues("learning").Inc()
+		return
+	}
+	newDomainCount.WithLabelValues("new").Inc()
+	out, err := encode(d.redact, &NewDomain{
+		Domain:    domain,
+		QName:     qname,
+		Client:    dt.QueryAddress,
+		Identity:  dt.Identity,
+		Timestamp: dt.Timestamp,
+	})
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	d.pub.Go(*newDomainTopic, out)
+}
+
+// run rotates generations and saves state periodically.
+func (d *detector) run() {
+	interval := *newDomainSave
+	if *newDomainRotate < interval {
+		interval = *newDomainRotate
+	}
+	for now := range time.Tick(interval) {
+		if now.Sub(d.seen.Rotated()) >= *newDomainRotate {
+			d.seen.Rotate(now)
+		}
+		d.flush()
+	}
+}
+
+// advance starts learning and rotates generations in message time.
+func (d *detector) advance(now time.Time) {
+	if d.learnFor > 0 && d.learn.IsZero() {
+		d.learn = now.Add(d.learnFor)
+	}
+	if d.rotated.IsZero() {
+		d.rotated = now
+	}
+	if now.Sub(d.rotated) >= *newDomainRotate {
+		d.seen.Rotate(now)
+		d.rotated = now
+	}
+}
+
+// flush saves state, if there is somewhere to save it.
+func (d *detector) flush() {
+	if d.path == "" {
+		return
+	}
+	if err := d.seen.Save(d.path); err != nil {
+		glog.Error(err)
+	}
+}
+
+// registeredDomain returns the domain under a public suffix that name
+// belongs to, such as example.co.uk for www.example.co.uk, or the empty
+// string for reverse lookups and names under unlisted suffixes.
+func registeredDomain(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if strings.HasSuffix(name, ".arpa") {
+		return ""
+	}
+	if suffix, icann := publicsuffix.PublicSuffix(name); !icann && !strings.Contains(suffix, ".") {
+		// unlisted TLDs such as .lan or .local
+		return ""
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pairedTopic = flag.String("mqtt_topic_paired", "", "MQTT topic to publish joined client query/response records, or empty to disable")
+	pairTimeout = flag.Duration("pair_timeout", 5*time.Second, "how long to wait for a response before publishing a query as unanswered")
+	pairMax     = flag.Int("pair_max_outstanding", 100000, "maximum number of queries awaiting responses")
+
+	latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "dnstap",
+		Name:      "latency_seconds",
+		Help:      "latency of client queries",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 18),
+	}, []string{"qtype", "rcode"})
+	pairCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dnstap",
+		Name:      "pairs",
+		Help:      "count of client query/response pairing outcomes",
+	}, []string{"result"})
+	outstanding = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "dnstap",
+		Name:      "pairs_outstanding",
+		Help:      "count of client queries awaiting responses",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(latency)
+	prometheus.MustRegister(pairCount)
+	prometheus.MustRegister(outstanding)
+}
+
+// Pair is a client query joined with its response.
+type Pair struct {
+	Query    *DNSTap
+	Response *DNSTap
+	Answered bool
+	// Latency is the time between query and response, in seconds.
+	Latency float64
+}
+
+type pairKey struct {
+	addr          string
+	port          uint32
+	id            uint16
+	name          string
+	qtype, qclass uint16
+}
+
+func keyOf(dt *DNSTap) (pairKey, bool) {
+	if len(dt.Message.Question) == 0 {
+		return pairKey{}, false
+	}
+	q := dt.Message.Question[0]
+	return pairKey{
+		addr:   dt.QueryAddress,
+		port:   dt.QueryPort,
+		id:     dt.Message.Id,
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+	}, true
+}
+
+type pending struct {
+	key     pairKey
+	query   *DNSTap
+	expires time.Time
+}
+
+// pairer joins CLIENT_QUERY and CLIENT_RESPONSE messages. Queries wait for
+// their responses for a fixed time, in a cache of bounded size; queries that
+// time out or are evicted are published as unanswered.
+type pairer struct {
+	pub    *pub.Publisher
+	redact *redact.Redactor
+	ttl    time.Duration
+	max    int
+
+	mu    sync.Mutex
+	queue *list.List // of *pending, oldest first
+	byKey map[pairKey]*list.Element
+}
+
+func newPairer(p *pub.Publisher, r *redact.Redactor, ttl time.Duration, max int) *pairer {
+	return &pairer{
+		pub:    p,
+		redact: r,
+		ttl:    ttl,
+		max:    max,
+		queue:  list.New(),
+		byKey:  make(map[pairKey]*list.Element),
+	}
+}
+
+func (pr *pairer) process(dt *DNSTap) {
+	now := timeOf(dt)
+	pr.publish(pr.add(dt, now))
+	if messageTime {
+		pr.publish(pr.expire(now))
+	}
+}
+
+// flush publishes all outstanding queries as unanswered.
+func (pr *pairer) flush() {
+	pr.publish(pr.drain())
+}
+
+// run periodically publishes queries that have timed out.
+func (pr *pairer) run() {
+	interval := pr.ttl / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for now := range t.C {
+		pr.publish(pr.expire(now))
+	}
+}
+
+func (pr *pairer) publish(pairs []*Pair) {
+	for _, p := range pairs {
+		out, err := encode(pr.redact, p)
+		if err != nil {
+			glog.Error(err)
+			continue
+		}
+		pr.pub.Go(*pairedTopic, out)
+	}
+}
+
+// add records a cooked message arriving at time now. It returns the completed
+// pair if dt answers an outstanding query, along with any queries evicted to
+// make room.
+func (pr *pairer) add(dt *DNSTap, now time.Time) []*Pair {
+	key, ok := keyOf(dt)
+	if !ok {
+		return nil
+	}
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	defer func() { outstanding.Set(float64(pr.queue.Len())) }()
+	switch dt.Type {
+	case "CLIENT_QUERY":
+		if _, ok := pr.byKey[key]; ok {
+			pairCount.WithLabelValues("duplicate").Inc()
+			return nil
+		}
+		var evicted []*Pair
+		for pr.max > 0 && pr.queue.Len() >= pr.max {
+			evicted = append(evicted, pr.remove(pr.queue.Front(), "evicted"))
+		}
+		pr.byKey[key] = pr.queue.PushBack(&pending{
+			key:     key,
+			query:   dt,
+			expires: now.Add(pr.ttl),
+		})
+		return evicted
+	case "CLIENT_RESPONSE":
+		e, ok := pr.byKey[key]
+		if !ok {
+			pairCount.WithLabelValues("orphan").Inc()
+			return nil
+		}
+		p := pr.remove(e, "answered")
+		p.Response = dt
+		p.Answered = true
+		p.Latency = dt.Timestamp.Sub(p.Query.Timestamp).Seconds()
+		latency.WithLabelValues(typeName(key.qtype), rcodeName(dt.Message.Rcode)).Observe(p.Latency)
+		return []*Pair{p}
+	}
+	return nil
+}
+
+// expire removes and returns all queries that expired before now.
+func (pr *pairer) expire(now time.Time) []*Pair {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	var expired []*Pair
+	for e := pr.queue.Front(); e != nil && e.Value.(*pending).expires.Before(now); e = pr.queue.Front() {
+		expired = append(expired, pr.remove(e, "unanswered"))
+	}
+	outstanding.Set(float64(pr.queue.Len()))
+	return expired
+}
+
+// drain removes all outstanding queries, returning them as unanswered Pairs.
+func (pr *pairer) drain() []*Pair {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	var drained []*Pair
+	for e := pr.queue.Front(); e != nil; e = pr.queue.Front() {
+		drained = append(drained, pr.remove(e, "unanswered"))
+	}
+	outstanding.Set(0)
+	return drained
+}
+
+// remove drops e from the cache, returning a pair containing its query.
+func (pr *pairer) remove(e *list.Element, result string) *Pair {
+	p := pr.queue.Remove(e).(*pending)
+	delete(pr.byKey, p.key)
+	pairCount.WithLabelValues(result).Inc()
+	return &Pair{Query: p.query}
+}
+
+// typeName returns the mnemonic for a DNS RR type, or its number if it has
+// none.
+func typeName(t uint16) string {
+	if s, ok := dns.TypeToString[t]; ok {
+		return s
+	}
+	return strconv.Itoa(int(t))
+}
+
+// rcodeName returns the mnemonic for a DNS response code, or its number if it
+// has none.
+func rcodeName(rc int) string {
+	if s, ok := dns.RcodeToString[rc]; ok {
+		return s
+	}
+	return strconv.Itoa(rc)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func clientMsg(typ string, port uint32, id uint16, ts time.Time) *DNSTap {
+	dt := &DNSTap{
+		Type:         typ,
+		QueryAddress: "192.168.8.68",
+		QueryPort:    port,
+		Timestamp:    ts,
+	}
+	dt.Message.Id = id
+	dt.Message.Question = []dns.Question{{Name: "www.Example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+	return dt
+}
+
+func TestPairer_Answered(t *testing.T) {
+	pr := newPairer(nil, nil, time.Second, 10)
+	now := time.Now()
+	if got := pr.add(clientMsg("CLIENT_QUERY", 5353, 1, now), now); len(got) != 0 {
+		t.Fatalf("add(query) = %v; want nothing", got)
+	}
+	resp := clientMsg("CLIENT_RESPONSE", 5353, 1, now.Add(20*time.Millisecond))
+	resp.Message.Question[0].Name = "www.example.com."
+	got := pr.add(resp, now)
+	if len(got) != 1 {
+		t.Fatalf("add(response) = %v; want one pair", got)
+	}
+	if !got[0].Answered || got[0].Response != resp {
+		t.Errorf("pair = %+v; want answered by response", got[0])
+	}
+	if want := 0.02; got[0].Latency < want-0.001 || got[0].Latency > want+0.001 {
+		t.Errorf("latency = %f; want %f", got[0].Latency, want)
+	}
+	if got := pr.expire(now.Add(time.Hour)); len(got) != 0 {
+		t.Errorf("expire() = %v; want nothing", got)
+	}
+}
+
+func TestPairer_Unanswered(t *testing.T) {
+	pr := newPairer(nil, nil, time.Second, 10)
+	now := time.Now()
+	pr.add(clientMsg("CLIENT_QUERY", 5353, 1, now), now)
+	pr.add(clientMsg("CLIENT_QUERY", 5354, 1, now), now.Add(time.Second))
+	// a response from a different port doesn't match
+	if got := pr.add(clientMsg("CLIENT_RESPONSE", 5355, 1, now), now); len(got) != 0 {
+		t.Errorf("add(orphan) = %v; want nothing", got)
+	}
+	got := pr.expire(now.Add(1500 * time.Millisecond))
+	if len(got) != 1 {
+		t.Fatalf("expire() = %v; want one query", got)
+	}
+	if got[0].Answered || got[0].Query.QueryPort != 5353 {
+		t.Errorf("expired pair = %+v; want unanswered query from port 5353", got[0])
+	}
+}
+
+func TestPairer_Evict(t *testing.T) {
+	pr := newPairer(nil, nil, time.Second, 2)
+	now := time.Now()
+	for id := uint16(1); id <= 2; id++ {
+		if got := pr.add(clientMsg("CLIENT_QUERY", 5353, id, now), now); len(got) != 0 {
+			t.Fatalf("add(%d) = %v; want nothing", id, got)
+		}
+	}
+	got := pr.add(clientMsg("CLIENT_QUERY", 5353, 3, now), now)
+	if len(got) != 1 || got[0].Query.Message.Id != 1 {
+		t.Fatalf("add(3) = %v; want eviction of query 1", got)
+	}
+}
+
+func TestPairer_Unbounded(t *testing.T) {
+	pr := newPairer(nil, nil, time.Second, 0)
+	now := time.Now()
+	for port := uint32(5353); port < 5356; port++ {
+		if got := pr.add(clientMsg("CLIENT_QUERY", port, 1, now), now); len(got) != 0 {
+			t.Errorf("add(query) = %v; want nothing", got)
+		}
+	}
+	if pr.queue.Len() != 3 {
+		t.Errorf("%d queries outstanding; want 3", pr.queue.Len())
+	}
+}
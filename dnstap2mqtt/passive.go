@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/dichro/pubsub-logging/dnstap2mqtt/pdns"
+	"github.com/golang/glog"
+)
+
+var (
+	pdnsDB    = flag.String("pdns_db", "", "file to keep a passive DNS database of CLIENT_RESPONSE answers in, served on --http_listen under /pdns/")
+	pdnsFlush = flag.Duration("pdns_flush", 10*time.Second, "how often to write passive DNS records to disk")
+)
+
+// recorder adds the answers in client responses to a passive DNS database.
+type recorder struct {
+	store *pdns.Store
+}
+
+func (r *recorder) process(dt *DNSTap) {
+	if dt.Type != "CLIENT_RESPONSE" {
+		return
+	}
+	for _, rr := range dt.Message.Answer {
+		h := rr.Header()
+		r.store.Add(h.Name, typeName(h.Rrtype), rdata(rr), dt.Timestamp)
+	}
+}
+
+// run periodically flushes the database.
+func (r *recorder) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.flush()
+	}
+}
+
+func (r *recorder) flush() {
+	if err := r.store.Flush(); err != nil {
+		glog.Error(err)
+	}
+}
@@ -0,0 +1,278 @@
+// Package pdns maintains a passive DNS database: the resource records seen
+// in DNS responses, with when they were first and last seen and how often.
+//
+// Records are served over HTTP in the Passive DNS Common Output Format.
+package pdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// rrBucket maps rrname\0rrtype\0rdata to an encoded record.
+	rrBucket = []byte("rr")
+	// rdataBucket maps rdata\0rrname\0rrtype to nothing, for lookups by
+	// rdata.
+	rdataBucket = []byte("rdata")
+)
+
+// Record is an aggregated resource record.
+type Record struct {
+	RRName    string    `json:"rrname"`
+	RRType    string    `json:"rrtype"`
+	RData     string    `json:"rdata"`
+	FirstSeen time.Time `json:"time_first"`
+	LastSeen  time.Time `json:"time_last"`
+	Count     uint64    `json:"count"`
+}
+
+type key struct {
+	rrname, rrtype, rdata string
+}
+
+func (k key) rr() []byte {
+	return []byte(k.rrname + "\x00" + k.rrtype + "\x00" + k.rdata)
+}
+
+func (k key) index() []byte {
+	return []byte(k.rdata + "\x00" + k.rrname + "\x00" + k.rrtype)
+}
+
+type seen struct {
+	first, last int64
+	count       uint64
+}
+
+func (s *seen) merge(o seen) {
+	if s.count == 0 || o.first < s.first {
+		s.first = o.first
+	}
+	if o.last > s.last {
+		s.last = o.last
+	}
+	s.count += o.count
+}
+
+func (s seen) marshal() []byte {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint64(b[0:], uint64(s.first))
+	binary.BigEndian.PutUint64(b[8:], uint64(s.last))
+	binary.BigEndian.PutUint64(b[16:], s.count)
+	return b
+}
+
+func unmarshal(b []byte) seen {
+	if len(b) != 24 {
+		return seen{}
+	}
+	return seen{
+		first: int64(binary.BigEndian.Uint64(b[0:])),
+		last:  int64(binary.BigEndian.Uint64(b[8:])),
+		count: binary.BigEndian.Uint64(b[16:]),
+	}
+}
+
+// Store is a passive DNS database. Records are buffered in memory until
+// Flush is called. It is safe for concurrent use.
+type Store struct {
+	db *bolt.DB
+
+	mu      sync.Mutex
+	pending map[key]*seen
+}
+
+// Open opens, or creates, the database at path.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{rrBucket, rdataBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, pending: make(map[key]*seen)}, nil
+}
+
+// Close flushes and closes the database.
+func (s *Store) Close() error {
+	if err := s.Flush(); err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
+
+// Add records a sighting of a resource record at time t.
+func (s *Store) Add(rrname, rrtype, rdata string, t time.Time) {
+	k := key{normalise(rrname), rrtype, rdata}
+	ts := t.UnixNano()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pending[k]
+	if !ok {
+		p = &seen{}
+		s.pending[k] = p
+	}
+	p.merge(seen{first: ts, last: ts, count: 1})
+}
+
+// Flush writes buffered sightings to the database. If that fails, they stay
+// buffered.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[key]*seen)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		rr, idx := tx.Bucket(rrBucket), tx.Bucket(rdataBucket)
+		for k, p := range pending {
+			kb := k.rr()
+			old := unmarshal(rr.Get(kb))
+			old.merge(*p)
+			if err := rr.Put(kb, old.marshal()); err != nil {
+				return err
+			}
+			if err := idx.Put(k.index(), []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// keep the sightings for the next flush
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for k, p := range pending {
+			if q, ok := s.pending[k]; ok {
+				p.merge(*q)
+			}
+			s.pending[k] = p
+		}
+	}
+	return err
+}
+
+// ByName returns the records for rrname.
+func (s *Store) ByName(rrname string) ([]Record, error) {
+	var records []Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(rrBucket).Cursor()
+		prefix := []byte(normalise(rrname) + "\x00")
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			parts := strings.SplitN(string(k), "\x00", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			records = append(records, record(key{parts[0], parts[1], parts[2]}, unmarshal(v)))
+		}
+		return nil
+	})
+	sortRecords(records)
+	return records, err
+}
+
+// ByRData returns the records whose data is rdata, such as the A and AAAA
+// records for an address.
+func (s *Store) ByRData(rdata string) ([]Record, error) {
+	var records []Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c, rr := tx.Bucket(rdataBucket).Cursor(), tx.Bucket(rrBucket)
+		prefix := []byte(rdata + "\x00")
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			parts := strings.SplitN(string(k), "\x00", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			rk := key{parts[1], parts[2], parts[0]}
+			if v := rr.Get(rk.rr()); v != nil {
+				records = append(records, record(rk, unmarshal(v)))
+			}
+		}
+		return nil
+	})
+	sortRecords(records)
+	return records, err
+}
+
+func record(k key, s seen) Record {
+	return Record{
+		RRName:    k.rrname,
+		RRType:    k.rrtype,
+		RData:     k.rdata,
+		FirstSeen: time.Unix(0, s.first).UTC(),
+		LastSeen:  time.Unix(0, s.last).UTC(),
+		Count:     s.count,
+	}
+}
+
+// sortRecords orders records most recently seen first.
+func sortRecords(records []Record) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+}
+
+func normalise(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Handler serves /pdns/ip/<address> and /pdns/name/<rrname> as JSON arrays
+// of Records.
+func Handler(s *Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			records []Record
+			err     error
+		)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/pdns/ip/"):
+			ip := net.ParseIP(strings.TrimPrefix(r.URL.Path, "/pdns/ip/"))
+			if ip == nil {
+				http.Error(w, "invalid IP address", http.StatusBadRequest)
+				return
+			}
+			records, err = s.ByRData(ip.String())
+		case strings.HasPrefix(r.URL.Path, "/pdns/name/"):
+			name := strings.TrimPrefix(r.URL.Path, "/pdns/name/")
+			if name == "" {
+				http.Error(w, "missing name", http.StatusBadRequest)
+				return
+			}
+			records, err = s.ByName(name)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if records == nil {
+			records = []Record{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	})
+}
@@ -0,0 +1,142 @@
+package pdns
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openStore(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "pdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := Open(filepath.Join(dir, "pdns.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStore(t *testing.T) {
+	s := openStore(t)
+	t0 := time.Date(2020, 2, 17, 19, 52, 34, 0, time.UTC)
+	s.Add("www.Example.com.", "A", "93.184.216.34", t0.Add(time.Minute))
+	s.Add("www.example.com", "A", "93.184.216.34", t0)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s.Add("www.example.com.", "A", "93.184.216.34", t0.Add(time.Hour))
+	s.Add("cdn.example.net.", "A", "93.184.216.34", t0)
+	s.Add("www.example.com.", "CNAME", "cdn.example.net.", t0)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := s.ByName("WWW.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("ByName() = %v; want 2 records", records)
+	}
+	want := Record{
+		RRName:    "www.example.com",
+		RRType:    "A",
+		RData:     "93.184.216.34",
+		FirstSeen: t0,
+		LastSeen:  t0.Add(time.Hour),
+		Count:     3,
+	}
+	if records[0] != want {
+		t.Errorf("ByName()[0] = %+v; want %+v", records[0], want)
+	}
+
+	records, err = s.ByRData("93.184.216.34")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].RRName != "www.example.com" || records[1].RRName != "cdn.example.net" {
+		t.Errorf("ByRData() = %v; want www.example.com then cdn.example.net", records)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := openStore(t)
+	s.Add("www.example.com.", "AAAA", "2606:2800:220:1:248:1893:25c8:1946", time.Now())
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(Handler(s))
+	defer srv.Close()
+	for path, want := range map[string]int{
+		"/pdns/ip/2606:2800:0220:0001:0248:1893:25c8:1946": 1,
+		"/pdns/ip/192.0.2.1":         0,
+		"/pdns/name/www.example.com": 1,
+		"/pdns/name/example.com":     0,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []Record
+		err = json.NewDecoder(resp.Body).Decode(&records)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if len(records) != want {
+			t.Errorf("%s returned %v; want %d records", path, records, want)
+		}
+	}
+	for path, want := range map[string]int{
+		"/pdns/ip/nonsense": http.StatusBadRequest,
+		"/pdns/other":       http.StatusNotFound,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s returned %d; want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestStore_FailedFlush(t *testing.T) {
+	s := openStore(t)
+	t0 := time.Date(2020, 2, 17, 19, 52, 34, 0, time.UTC)
+	s.Add("www.example.com.", "A", "93.184.216.34", t0)
+	path := s.db.Path()
+	s.db.Close()
+	if err := s.Flush(); err == nil {
+		t.Fatal("Flush() to closed database succeeded")
+	}
+	s.Add("www.example.com.", "A", "93.184.216.34", t0.Add(time.Minute))
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db = db
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	records, err := s.ByName("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Count != 2 || !records[0].FirstSeen.Equal(t0) {
+		t.Errorf("ByName() = %v; want one record seen twice from %v", records, t0)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"io"
+	"os"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	replaySpeed    = flag.Float64("replay_speed", 0, "when replaying capture files, how many times faster than they were captured to send messages, or 0 for as fast as possible")
+	replayInflight = flag.Int("replay_max_inflight", 1000, "when replaying capture files, maximum number of MQTT publishes outstanding before replay waits for them")
+)
+
+// messageTime makes stages with windows and timeouts run on the timestamps
+// of messages rather than the clock, as when replaying captures. Their
+// periodic work is then done as messages arrive, not on tickers.
+var messageTime bool
+
+// timeOf returns the time at which to process dt.
+func timeOf(dt *DNSTap) time.Time {
+	if messageTime && !dt.Timestamp.IsZero() {
+		return dt.Timestamp
+	}
+	return time.Now()
+}
+
+// A flusher is a stage that buffers state which should be written out
+// before exiting after a replay.
+type flusher interface {
+	flush()
+}
+
+// replay sends the frames in each capture file in turn to ch. Files may be
+// Frame Streams dnstap captures or pcap packet captures.
+func replay(files []string, speed float64, ch chan<- []byte) error {
+	var pc *pacer
+	if speed > 0 {
+		pc = &pacer{speed: speed}
+	}
+	for _, name := range files {
+		if err := replayFile(name, pc, ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replayFile(name string, pc *pacer, ch chan<- []byte) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return err
+	}
+	frames := make(chan []byte)
+	if isPcap(magic) {
+		s, err := newSniffer(frames)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.Read(r); err != nil {
+				glog.Errorf("%s: %v", name, err)
+			}
+			close(frames)
+		}()
+	} else {
+		in, err := dnstap.NewFrameStreamInput(readWriter{r}, false)
+		if err != nil {
+			return err
+		}
+		go func() {
+			in.ReadInto(frames)
+			close(frames)
+		}()
+	}
+	start := time.Now()
+	n := 0
+	for buf := range frames {
+		if pc != nil {
+			pc.wait(buf)
+		}
+		ch <- buf
+		n++
+	}
+	glog.Infof("%s: replayed %d frames in %s", name, n, time.Since(start))
+	return nil
+}
+
+// isPcap reports whether magic is the start of a pcap or pcapng file.
+func isPcap(magic []byte) bool {
+	switch binary.BigEndian.Uint32(magic) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1, 0x0a0d0d0a:
+		return true
+	}
+	return false
+}
+
+// readWriter adapts a reader for dnstap.NewFrameStreamInput, which never
+// writes in unidirectional mode.
+type readWriter struct {
+	io.Reader
+}
+
+func (readWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// pacer delays frames so they are sent at a multiple of the rate they were
+// captured at.
+type pacer struct {
+	speed float64
+	// first is the timestamp of the first frame, and start when it was sent.
+	first, start time.Time
+}
+
+func (p *pacer) wait(buf []byte) {
+	var msg dnstap.Dnstap
+	if err := proto.Unmarshal(buf, &msg); err != nil {
+		return
+	}
+	ts := frameTime(msg.GetMessage())
+	if ts.IsZero() {
+		return
+	}
+	if d := p.delay(ts, time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// delay returns how long to wait at now before sending a frame captured at
+// ts.
+func (p *pacer) delay(ts, now time.Time) time.Duration {
+	if p.first.IsZero() {
+		p.first, p.start = ts, now
+		return 0
+	}
+	due := p.start.Add(time.Duration(float64(ts.Sub(p.first)) / p.speed))
+	return due.Sub(now)
+}
+
+// frameTime returns when m was captured, or the zero time if it has no
+// timestamp.
+func frameTime(m *dnstap.Message) time.Time {
+	if m == nil {
+		return time.Time{}
+	}
+	if sec := m.GetResponseTimeSec(); sec > 0 {
+		return time.Unix(int64(sec), int64(m.GetResponseTimeNsec()))
+	}
+	if sec := m.GetQueryTimeSec(); sec > 0 {
+		return time.Unix(int64(sec), int64(m.GetQueryTimeNsec()))
+	}
+	return time.Time{}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+)
+
+func TestPacer(t *testing.T) {
+	p := &pacer{speed: 2}
+	captured := time.Date(2020, 2, 17, 19, 52, 34, 0, time.UTC)
+	now := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		ts, now time.Duration
+		want    time.Duration
+	}{
+		{0, 0, 0},
+		{10 * time.Second, time.Second, 4 * time.Second},
+		{10 * time.Second, 6 * time.Second, -time.Second},
+		{time.Minute, 30 * time.Second, 0},
+	} {
+		if got := p.delay(captured.Add(tc.ts), now.Add(tc.now)); got != tc.want {
+			t.Errorf("delay(+%s, +%s) = %s; want %s", tc.ts, tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestReplayFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.dnstap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := dnstap.NewFrameStreamOutput(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go out.RunOutputLoop()
+	want := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	for _, frame := range want {
+		out.GetOutputChannel() <- frame
+	}
+	out.Close()
+	f.Close()
+
+	ch := make(chan []byte, len(want)+1)
+	if err := replayFile(path, nil, ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var got [][]byte
+	for frame := range ch {
+		got = append(got, frame)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("replayed %q; want %q", got, want)
+	}
+}
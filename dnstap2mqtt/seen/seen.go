@@ -0,0 +1,188 @@
+// Package seen remembers which keys have been seen recently, in bounded
+// memory, using a ring of Bloom filters. Keys are forgotten some time after
+// they were last seen, once all the filters they were added to have been
+// rotated out.
+package seen
+
+import (
+	"encoding/gob"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Filter is a rotating Bloom filter. It may report that a key has been seen
+// when it hasn't, with a false-positive rate set at creation, but never the
+// reverse. It is safe for concurrent use.
+type Filter struct {
+	mu      sync.Mutex
+	state   state
+	scratch []uint64
+}
+
+// state is the persistent part of a Filter.
+type state struct {
+	Bits    uint64
+	Hashes  int
+	Rotated time.Time
+	// Generations holds the bit sets, newest first.
+	Generations [][]uint64
+}
+
+// New returns a Filter of the given number of generations, each sized to
+// hold capacity keys with the given false-positive rate.
+func New(capacity int, fpRate float64, generations int) *Filter {
+	bits, hashes, generations := size(capacity, fpRate, generations)
+	f := &Filter{state: state{
+		Bits:        bits,
+		Hashes:      hashes,
+		Rotated:     time.Now(),
+		Generations: make([][]uint64, generations),
+	}}
+	for i := range f.state.Generations {
+		f.state.Generations[i] = make([]uint64, bits/64)
+	}
+	return f
+}
+
+// size returns the bits per generation, number of hashes and number of
+// generations for a Filter.
+func size(capacity int, fpRate float64, generations int) (uint64, int, int) {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if generations < 1 {
+		generations = 1
+	}
+	bits := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	bits = (bits + 63) &^ 63
+	hashes := int(math.Round(float64(bits) / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return bits, hashes, generations
+}
+
+// Fits reports whether the filter is the size New would make it for the
+// given parameters, as a loaded filter may not be.
+func (f *Filter) Fits(capacity int, fpRate float64, generations int) bool {
+	bits, hashes, generations := size(capacity, fpRate, generations)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state.Bits == bits && f.state.Hashes == hashes && len(f.state.Generations) == generations
+}
+
+// Seen adds key to the filter, and reports whether it was already there.
+func (f *Filter) Seen(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scratch = f.positions(key, f.scratch[:0])
+	seen := false
+	for _, g := range f.state.Generations {
+		if contains(g, f.scratch) {
+			seen = true
+			break
+		}
+	}
+	// refresh the key in the newest generation so that it is remembered
+	// from when it was last seen, not when it was first seen
+	for _, p := range f.scratch {
+		f.state.Generations[0][p/64] |= 1 << (p % 64)
+	}
+	return seen
+}
+
+func contains(g []uint64, positions []uint64) bool {
+	for _, p := range positions {
+		if g[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// positions returns the bit positions for key, using double hashing.
+func (f *Filter) positions(key string, out []uint64) []uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, (sum>>32)|1
+	for i := 0; i < f.state.Hashes; i++ {
+		out = append(out, (h1+uint64(i)*h2)%f.state.Bits)
+	}
+	return out
+}
+
+// Rotate discards the oldest generation and starts a new one.
+func (f *Filter) Rotate(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	gens := f.state.Generations
+	oldest := gens[len(gens)-1]
+	for i := range oldest {
+		oldest[i] = 0
+	}
+	copy(gens[1:], gens[:len(gens)-1])
+	gens[0] = oldest
+	f.state.Rotated = now
+}
+
+// Rotated returns the time of the last rotation.
+func (f *Filter) Rotated() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state.Rotated
+}
+
+// Save atomically writes the filter to the file at path.
+func (f *Filter) Save(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// encode a copy, so as not to hold up Seen while writing
+	f.mu.Lock()
+	snapshot := f.state
+	snapshot.Generations = make([][]uint64, len(f.state.Generations))
+	for i, g := range f.state.Generations {
+		snapshot.Generations[i] = append([]uint64(nil), g...)
+	}
+	f.mu.Unlock()
+	if err := gob.NewEncoder(tmp).Encode(&snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads a filter previously written by Save.
+func Load(path string) (*Filter, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	f := &Filter{}
+	if err := gob.NewDecoder(r).Decode(&f.state); err != nil {
+		return nil, err
+	}
+	if f.state.Bits == 0 || f.state.Hashes < 1 || len(f.state.Generations) == 0 {
+		return nil, errors.New("invalid filter state")
+	}
+	for _, g := range f.state.Generations {
+		if uint64(len(g))*64 != f.state.Bits {
+			return nil, errors.New("invalid filter state")
+		}
+	}
+	return f, nil
+}
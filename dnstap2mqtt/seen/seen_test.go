@@ -0,0 +1,84 @@
+package seen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	f := New(1000, 0.001, 3)
+	if f.Seen("example.com") {
+		t.Error("Seen(example.com) = true on first sight")
+	}
+	if !f.Seen("example.com") {
+		t.Error("Seen(example.com) = false on second sight")
+	}
+	fp := 0
+	for i := 0; i < 1000; i++ {
+		if f.Seen(fmt.Sprintf("domain%d.example", i)) {
+			fp++
+		}
+	}
+	if fp > 10 {
+		t.Errorf("%d false positives in 1000; want about 1", fp)
+	}
+}
+
+func TestFilter_Rotate(t *testing.T) {
+	f := New(100, 0.001, 2)
+	now := time.Now()
+	f.Seen("old.example")
+	f.Seen("refreshed.example")
+	f.Rotate(now)
+	if !f.Seen("refreshed.example") {
+		t.Error("forgot refreshed.example after one rotation")
+	}
+	f.Rotate(now)
+	if !f.Seen("refreshed.example") {
+		t.Error("forgot refreshed.example after it was refreshed")
+	}
+	if f.Seen("old.example") {
+		t.Error("remembered old.example after two rotations")
+	}
+	if want, got := now, f.Rotated(); !want.Equal(got) {
+		t.Errorf("Rotated() = %v; want %v", got, want)
+	}
+}
+
+func TestFilter_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	f := New(100, 0.01, 2)
+	f.Seen("example.com")
+	if err := f.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.Seen("example.com") {
+		t.Error("loaded filter forgot example.com")
+	}
+	if g.Seen("example.org") {
+		t.Error("loaded filter remembers example.org")
+	}
+	if !g.Fits(100, 0.01, 2) {
+		t.Error("loaded filter doesn't fit its own parameters")
+	}
+	if g.Fits(1000, 0.01, 2) || g.Fits(100, 0.01, 3) {
+		t.Error("loaded filter fits different parameters")
+	}
+	if _, err := Load(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Load(missing) = %v; want not-exist error", err)
+	}
+}
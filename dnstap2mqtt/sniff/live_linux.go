@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package sniff
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Live sniffs packets on the named network interface until an error occurs.
+func (s *Sniffer) Live(iface string) error {
+	h, err := pcapgo.NewEthernetHandle(iface)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	if len(s.filter) > 0 {
+		if err := h.SetBPF(s.filter); err != nil {
+			return err
+		}
+	}
+	for {
+		data, ci, err := h.ReadPacketData()
+		if err != nil {
+			return err
+		}
+		s.Packet(gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true}), ci.Timestamp)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package sniff
+
+import "errors"
+
+// Live is only supported on Linux.
+func (s *Sniffer) Live(iface string) error {
+	return errors.New("live capture is only supported on linux")
+}
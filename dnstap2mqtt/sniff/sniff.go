@@ -0,0 +1,380 @@
+// Package sniff synthesises dnstap messages from captured DNS traffic, for
+// resolvers that can't log dnstap themselves.
+//
+// Queries to port 53 become CLIENT_QUERY messages and responses from it
+// CLIENT_RESPONSE messages. DNS over TCP is reassembled; fragmented IP
+// datagrams are not.
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/bpf"
+)
+
+const (
+	dnsPort = 53
+	// maxStreams bounds the number of TCP connections being reassembled.
+	maxStreams = 10000
+	// streamTimeout is how long a TCP connection may be idle before it is
+	// forgotten.
+	streamTimeout = time.Minute
+	// maxPending bounds the out-of-order segments held for a connection.
+	maxPending = 64
+)
+
+var (
+	packetCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dnstap",
+		Name:      "sniffed_packets",
+		Help:      "count of captured packets, by result",
+	}, []string{"result"})
+	streamCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "dnstap",
+		Name:      "sniffed_streams",
+		Help:      "count of TCP DNS connections being reassembled",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(packetCount)
+	prometheus.MustRegister(streamCount)
+}
+
+// ParseFilter parses a BPF program in the format printed by "tcpdump -ddd":
+// the number of instructions followed by one "code jt jf k" instruction per
+// line. Commas may be used instead of newlines.
+func ParseFilter(s string) ([]bpf.RawInstruction, error) {
+	lines := strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' })
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, fmt.Errorf("bad BPF instruction count: %v", err)
+	}
+	if n != len(lines)-1 {
+		return nil, fmt.Errorf("BPF program has %d instructions; header says %d", len(lines)-1, n)
+	}
+	prog := make([]bpf.RawInstruction, 0, n)
+	for i, line := range lines[1:] {
+		f := strings.Fields(line)
+		if len(f) != 4 {
+			return nil, fmt.Errorf("BPF instruction %d: want 4 fields, got %q", i+1, line)
+		}
+		var v [4]uint64
+		for j, bits := range []int{16, 8, 8, 32} {
+			if v[j], err = strconv.ParseUint(f[j], 10, bits); err != nil {
+				return nil, fmt.Errorf("BPF instruction %d: %v", i+1, err)
+			}
+		}
+		prog = append(prog, bpf.RawInstruction{Op: uint16(v[0]), Jt: uint8(v[1]), Jf: uint8(v[2]), K: uint32(v[3])})
+	}
+	return prog, nil
+}
+
+// Sniffer turns captured packets into dnstap frames. It is not safe for
+// concurrent use.
+type Sniffer struct {
+	identity []byte
+	version  []byte
+	filter   []bpf.RawInstruction
+	vm       *bpf.VM
+	out      chan<- []byte
+
+	streams   map[streamKey]*stream
+	lastSweep time.Time
+}
+
+// New returns a Sniffer that sends frames identified as identity to out,
+// for packets that pass filter. A nil filter passes every packet.
+func New(identity string, filter []bpf.RawInstruction, out chan<- []byte) (*Sniffer, error) {
+	s := &Sniffer{
+		identity: []byte(identity),
+		version:  []byte("dnstap2mqtt sniff"),
+		filter:   filter,
+		out:      out,
+		streams:  make(map[streamKey]*stream),
+	}
+	if len(filter) > 0 {
+		prog, ok := bpf.Disassemble(filter)
+		if !ok {
+			return nil, fmt.Errorf("BPF program contains unknown instructions")
+		}
+		vm, err := bpf.NewVM(prog)
+		if err != nil {
+			return nil, err
+		}
+		s.vm = vm
+	}
+	return s, nil
+}
+
+// Read sniffs the packets in a pcap or pcapng capture file.
+func (s *Sniffer) Read(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return err
+	}
+	var src interface {
+		ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+		LinkType() layers.LinkType
+	}
+	if bytes.Equal(magic, []byte{0x0a, 0x0d, 0x0d, 0x0a}) {
+		src, err = pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	} else {
+		src, err = pcapgo.NewReader(br)
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		data, ci, err := src.ReadPacketData()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !s.match(data) {
+			packetCount.WithLabelValues("filtered").Inc()
+			continue
+		}
+		s.Packet(gopacket.NewPacket(data, src.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true}), ci.Timestamp)
+	}
+}
+
+func (s *Sniffer) match(data []byte) bool {
+	if s.vm == nil {
+		return true
+	}
+	n, err := s.vm.Run(data)
+	return err == nil && n > 0
+}
+
+// Packet sniffs a single packet captured at ts.
+func (s *Sniffer) Packet(p gopacket.Packet, ts time.Time) {
+	var src, dst net.IP
+	switch n := p.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, dst = n.SrcIP, n.DstIP
+	case *layers.IPv6:
+		src, dst = n.SrcIP, n.DstIP
+	default:
+		packetCount.WithLabelValues("not-ip").Inc()
+		return
+	}
+	switch t := p.TransportLayer().(type) {
+	case *layers.UDP:
+		ep := endpoints{src, dst, uint16(t.SrcPort), uint16(t.DstPort)}
+		if !ep.dns() {
+			packetCount.WithLabelValues("not-dns").Inc()
+			return
+		}
+		packetCount.WithLabelValues("udp").Inc()
+		s.emit(ep, dnstap.SocketProtocol_UDP, t.Payload, ts)
+	case *layers.TCP:
+		ep := endpoints{src, dst, uint16(t.SrcPort), uint16(t.DstPort)}
+		if !ep.dns() {
+			packetCount.WithLabelValues("not-dns").Inc()
+			return
+		}
+		packetCount.WithLabelValues("tcp").Inc()
+		s.segment(ep, t, ts)
+	default:
+		packetCount.WithLabelValues("not-dns").Inc()
+	}
+}
+
+// endpoints are the addresses of a packet.
+type endpoints struct {
+	src, dst         net.IP
+	srcPort, dstPort uint16
+}
+
+func (e endpoints) dns() bool {
+	return e.srcPort == dnsPort || e.dstPort == dnsPort
+}
+
+// emit sends a frame for the DNS message m, if it is one.
+func (s *Sniffer) emit(ep endpoints, sp dnstap.SocketProtocol, m []byte, ts time.Time) {
+	if len(m) < 12 {
+		packetCount.WithLabelValues("short").Inc()
+		return
+	}
+	response := m[2]&0x80 != 0
+	if response && ep.srcPort != dnsPort || !response && ep.dstPort != dnsPort {
+		packetCount.WithLabelValues("not-client").Inc()
+		return
+	}
+	frame, err := s.frame(ep, sp, response, m, ts)
+	if err != nil {
+		packetCount.WithLabelValues("marshal").Inc()
+		return
+	}
+	s.out <- frame
+}
+
+// frame returns a marshalled dnstap message for the DNS message m.
+func (s *Sniffer) frame(ep endpoints, sp dnstap.SocketProtocol, response bool, m []byte, ts time.Time) ([]byte, error) {
+	client, server := ep.src, ep.dst
+	clientPort, serverPort := uint32(ep.srcPort), uint32(ep.dstPort)
+	if response {
+		client, server = server, client
+		clientPort, serverPort = serverPort, clientPort
+	}
+	family := dnstap.SocketFamily_INET6
+	if c4 := client.To4(); c4 != nil {
+		family = dnstap.SocketFamily_INET
+		client, server = c4, server.To4()
+	}
+	msg := &dnstap.Message{
+		SocketFamily:    family.Enum(),
+		SocketProtocol:  sp.Enum(),
+		QueryAddress:    client,
+		QueryPort:       proto.Uint32(clientPort),
+		ResponseAddress: server,
+		ResponsePort:    proto.Uint32(serverPort),
+	}
+	sec, nsec := proto.Uint64(uint64(ts.Unix())), proto.Uint32(uint32(ts.Nanosecond()))
+	if response {
+		msg.Type = dnstap.Message_CLIENT_RESPONSE.Enum()
+		msg.ResponseTimeSec, msg.ResponseTimeNsec = sec, nsec
+		msg.ResponseMessage = append([]byte(nil), m...)
+	} else {
+		msg.Type = dnstap.Message_CLIENT_QUERY.Enum()
+		msg.QueryTimeSec, msg.QueryTimeNsec = sec, nsec
+		msg.QueryMessage = append([]byte(nil), m...)
+	}
+	return proto.Marshal(&dnstap.Dnstap{
+		Identity: s.identity,
+		Version:  s.version,
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Message:  msg,
+	})
+}
+
+// streamKey identifies one direction of a TCP connection.
+type streamKey struct {
+	src, dst         string
+	srcPort, dstPort uint16
+}
+
+// stream reassembles one direction of a TCP connection.
+type stream struct {
+	// start is the sequence number of the first byte of the stream, and
+	// next of the byte after those reassembled.
+	start   uint32
+	next    uint32
+	buf     []byte
+	pending map[uint32][]byte
+	last    time.Time
+}
+
+// segment adds a TCP segment to its stream and emits any DNS messages it
+// completes.
+func (s *Sniffer) segment(ep endpoints, t *layers.TCP, ts time.Time) {
+	s.sweep(ts)
+	k := streamKey{string(ep.src), string(ep.dst), ep.srcPort, ep.dstPort}
+	st, ok := s.streams[k]
+	seq := t.Seq
+	if t.SYN {
+		// the SYN takes up a sequence number before any data it carries,
+		// as with TCP Fast Open
+		seq++
+		if !ok || st.start != seq {
+			// a new connection, rather than a retransmitted SYN
+			if !ok && len(s.streams) >= maxStreams {
+				packetCount.WithLabelValues("too-many-streams").Inc()
+				return
+			}
+			st = &stream{start: seq, next: seq, pending: make(map[uint32][]byte)}
+			s.streams[k] = st
+		}
+	} else if !ok {
+		if len(t.Payload) == 0 || len(s.streams) >= maxStreams {
+			return
+		}
+		// joined mid-connection; assume this segment starts a message
+		st = &stream{start: seq, next: seq, pending: make(map[uint32][]byte)}
+		s.streams[k] = st
+	}
+	streamCount.Set(float64(len(s.streams)))
+	st.last = ts
+	st.add(seq, t.Payload)
+	for {
+		if len(st.buf) < 2 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(st.buf)) + 2
+		if len(st.buf) < n {
+			break
+		}
+		s.emit(ep, dnstap.SocketProtocol_TCP, st.buf[2:n], ts)
+		st.buf = st.buf[n:]
+	}
+	if t.FIN || t.RST {
+		delete(s.streams, k)
+		streamCount.Set(float64(len(s.streams)))
+	}
+}
+
+// add adds payload at sequence number seq to the stream.
+func (st *stream) add(seq uint32, payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+	switch d := int32(seq - st.next); {
+	case d > 0:
+		if len(st.pending) < maxPending {
+			st.pending[seq] = append([]byte(nil), payload...)
+		}
+		return
+	case d < 0:
+		// retransmission, possibly with some new data
+		if -d >= int32(len(payload)) {
+			return
+		}
+		payload = payload[-d:]
+	}
+	st.buf = append(st.buf, payload...)
+	st.next += uint32(len(payload))
+	for {
+		p, ok := st.pending[st.next]
+		if !ok {
+			return
+		}
+		delete(st.pending, st.next)
+		st.buf = append(st.buf, p...)
+		st.next += uint32(len(p))
+	}
+}
+
+// sweep forgets idle streams, at most once per streamTimeout.
+func (s *Sniffer) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < streamTimeout {
+		return
+	}
+	s.lastSweep = now
+	for k, st := range s.streams {
+		if now.Sub(st.last) > streamTimeout {
+			delete(s.streams, k)
+		}
+	}
+	streamCount.Set(float64(len(s.streams)))
+}
@@ -0,0 +1,243 @@
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/miekg/dns"
+)
+
+var (
+	client = net.ParseIP("192.168.8.68").To4()
+	server = net.ParseIP("192.168.8.1").To4()
+	start  = time.Date(2020, 2, 17, 19, 52, 34, 0, time.UTC)
+)
+
+// capture builds a pcap file of packets.
+type capture struct {
+	t   *testing.T
+	buf bytes.Buffer
+	w   *pcapgo.Writer
+	n   int
+}
+
+func newCapture(t *testing.T) *capture {
+	c := &capture{t: t}
+	c.w = pcapgo.NewWriter(&c.buf)
+	if err := c.w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (c *capture) write(src, dst net.IP, transport gopacket.SerializableLayer, payload []byte) {
+	ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: src, DstIP: dst}
+	switch l := transport.(type) {
+	case *layers.UDP:
+		ip.Protocol = layers.IPProtocolUDP
+		l.SetNetworkLayerForChecksum(ip)
+	case *layers.TCP:
+		ip.Protocol = layers.IPProtocolTCP
+		l.SetNetworkLayerForChecksum(ip)
+	}
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, transport, gopacket.Payload(payload)); err != nil {
+		c.t.Fatal(err)
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:     start.Add(time.Duration(c.n) * time.Millisecond),
+		CaptureLength: len(buf.Bytes()),
+		Length:        len(buf.Bytes()),
+	}
+	c.n++
+	if err := c.w.WritePacket(ci, buf.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func message(t *testing.T, name string, response bool) []byte {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	if response {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("104.21.1.1"),
+		}}
+		m = r
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// sniff returns the dnstap messages sniffed from a capture.
+func sniff(t *testing.T, c *capture, filter string) []*dnstap.Dnstap {
+	prog, err := ParseFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan []byte, 100)
+	s, err := New("resolver", prog, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Read(&c.buf); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var msgs []*dnstap.Dnstap
+	for buf := range ch {
+		msg := new(dnstap.Dnstap)
+		if err := proto.Unmarshal(buf, msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestSniffer_UDP(t *testing.T) {
+	c := newCapture(t)
+	c.write(client, server, &layers.UDP{SrcPort: 5353, DstPort: 53}, message(t, "www.purpleair.com.", false))
+	c.write(server, client, &layers.UDP{SrcPort: 53, DstPort: 5353}, message(t, "www.purpleair.com.", true))
+	c.write(client, server, &layers.UDP{SrcPort: 5353, DstPort: 123}, make([]byte, 48))
+
+	msgs := sniff(t, c, "")
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages; want 2", len(msgs))
+	}
+	q, r := msgs[0].GetMessage(), msgs[1].GetMessage()
+	if q.GetType() != dnstap.Message_CLIENT_QUERY || r.GetType() != dnstap.Message_CLIENT_RESPONSE {
+		t.Errorf("types = %s, %s; want CLIENT_QUERY, CLIENT_RESPONSE", q.GetType(), r.GetType())
+	}
+	for _, m := range []*dnstap.Message{q, r} {
+		if !net.IP(m.GetQueryAddress()).Equal(client) || m.GetQueryPort() != 5353 {
+			t.Errorf("%s query address = %v:%d; want %v:5353", m.GetType(), net.IP(m.GetQueryAddress()), m.GetQueryPort(), client)
+		}
+		if !net.IP(m.GetResponseAddress()).Equal(server) || m.GetResponsePort() != 53 {
+			t.Errorf("%s response address = %v:%d; want %v:53", m.GetType(), net.IP(m.GetResponseAddress()), m.GetResponsePort(), server)
+		}
+		if m.GetSocketProtocol() != dnstap.SocketProtocol_UDP || m.GetSocketFamily() != dnstap.SocketFamily_INET {
+			t.Errorf("%s socket = %s/%s; want INET/UDP", m.GetType(), m.GetSocketFamily(), m.GetSocketProtocol())
+		}
+	}
+	if want, got := start.Add(time.Millisecond), time.Unix(int64(r.GetResponseTimeSec()), int64(r.GetResponseTimeNsec())); !want.Equal(got) {
+		t.Errorf("response time = %s; want %s", got, want)
+	}
+	var m dns.Msg
+	if err := m.Unpack(r.GetResponseMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answer) != 1 {
+		t.Errorf("response has %d answers; want 1", len(m.Answer))
+	}
+	if string(msgs[0].GetIdentity()) != "resolver" {
+		t.Errorf("identity = %q; want resolver", msgs[0].GetIdentity())
+	}
+}
+
+func TestSniffer_TCP(t *testing.T) {
+	q, r := message(t, "example.com.", false), message(t, "example.com.", true)
+	framed := func(m []byte) []byte {
+		b := make([]byte, 2, len(m)+2)
+		binary.BigEndian.PutUint16(b, uint16(len(m)))
+		return append(b, m...)
+	}
+	fq, fr := framed(q), framed(r)
+
+	c := newCapture(t)
+	c.write(client, server, &layers.TCP{SrcPort: 40000, DstPort: 53, SYN: true, Seq: 1000}, nil)
+	c.write(server, client, &layers.TCP{SrcPort: 53, DstPort: 40000, SYN: true, ACK: true, Seq: 5000, Ack: 1001}, nil)
+	// the query arrives in two segments, out of order
+	c.write(client, server, &layers.TCP{SrcPort: 40000, DstPort: 53, ACK: true, PSH: true, Seq: 1001 + 10}, fq[10:])
+	c.write(client, server, &layers.TCP{SrcPort: 40000, DstPort: 53, ACK: true, Seq: 1001}, fq[:10])
+	// the response is retransmitted
+	c.write(server, client, &layers.TCP{SrcPort: 53, DstPort: 40000, ACK: true, PSH: true, Seq: 5001}, fr)
+	c.write(server, client, &layers.TCP{SrcPort: 53, DstPort: 40000, ACK: true, PSH: true, Seq: 5001}, fr)
+	c.write(server, client, &layers.TCP{SrcPort: 53, DstPort: 40000, ACK: true, FIN: true, Seq: 5001 + uint32(len(fr))}, nil)
+
+	msgs := sniff(t, c, "")
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages; want 2", len(msgs))
+	}
+	if m := msgs[0].GetMessage(); m.GetType() != dnstap.Message_CLIENT_QUERY || !bytes.Equal(m.GetQueryMessage(), q) {
+		t.Errorf("first message = %s %x; want CLIENT_QUERY %x", m.GetType(), m.GetQueryMessage(), q)
+	}
+	if m := msgs[1].GetMessage(); m.GetType() != dnstap.Message_CLIENT_RESPONSE || !bytes.Equal(m.GetResponseMessage(), r) {
+		t.Errorf("second message = %s %x; want CLIENT_RESPONSE %x", m.GetType(), m.GetResponseMessage(), r)
+	}
+	if p := msgs[0].GetMessage().GetSocketProtocol(); p != dnstap.SocketProtocol_TCP {
+		t.Errorf("protocol = %s; want TCP", p)
+	}
+}
+
+func TestSniffer_TCPFastOpen(t *testing.T) {
+	q := message(t, "example.com.", false)
+	fq := make([]byte, 2, len(q)+2)
+	binary.BigEndian.PutUint16(fq, uint16(len(q)))
+	fq = append(fq, q...)
+
+	c := newCapture(t)
+	// the SYN carries the start of the query, and is retransmitted after
+	// the rest has been sent
+	c.write(client, server, &layers.TCP{SrcPort: 40000, DstPort: 53, SYN: true, Seq: 1000}, fq[:10])
+	c.write(client, server, &layers.TCP{SrcPort: 40000, DstPort: 53, ACK: true, Seq: 1001 + 10}, fq[10:20])
+	c.write(client, server, &layers.TCP{SrcPort: 40000, DstPort: 53, SYN: true, Seq: 1000}, fq[:10])
+	c.write(client, server, &layers.TCP{SrcPort: 40000, DstPort: 53, ACK: true, PSH: true, Seq: 1001 + 20}, fq[20:])
+
+	msgs := sniff(t, c, "")
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages; want 1", len(msgs))
+	}
+	if m := msgs[0].GetMessage(); !bytes.Equal(m.GetQueryMessage(), q) {
+		t.Errorf("query = %x; want %x", m.GetQueryMessage(), q)
+	}
+}
+
+func TestSniffer_Filter(t *testing.T) {
+	c := newCapture(t)
+	c.write(client, server, &layers.UDP{SrcPort: 5353, DstPort: 53}, message(t, "example.com.", false))
+	c.write(server, client, &layers.UDP{SrcPort: 53, DstPort: 5353}, message(t, "example.com.", true))
+	// tcpdump -ddd 'ip src 192.168.8.1'
+	filter := "6,40 0 0 12,21 0 3 2048,32 0 0 26,21 0 1 3232237569,6 0 0 262144,6 0 0 0"
+	msgs := sniff(t, c, filter)
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages through filter; want 1", len(msgs))
+	}
+	if typ := msgs[0].GetMessage().GetType(); typ != dnstap.Message_CLIENT_RESPONSE {
+		t.Errorf("type = %s; want CLIENT_RESPONSE", typ)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	prog, err := ParseFilter("2\n40 0 0 12\n6 0 0 262144\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prog) != 2 || prog[0].Op != 40 || prog[1].K != 262144 {
+		t.Errorf("ParseFilter() = %v", prog)
+	}
+	for _, bad := range []string{"3\n40 0 0 12\n", "x", "1\n40 0 12"} {
+		if _, err := ParseFilter(bad); err == nil {
+			t.Errorf("ParseFilter(%q) succeeded; want error", bad)
+		}
+	}
+}
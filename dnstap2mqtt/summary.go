@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
+	"github.com/dichro/pubsub-logging/topk"
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+var (
+	summaryInterval = flag.Duration("summary_interval", 0, "interval over which to summarise client queries, or 0 to disable")
+	summaryTopic    = flag.String("mqtt_topic_summary", "dnstap/summary/json", "MQTT topic to publish periodic summaries of client queries")
+	summaryTop      = flag.Int("summary_top", 20, "number of top qnames and clients to include in summaries")
+	summaryCapacity = flag.Int("summary_capacity", 2000, "number of qnames and clients to track per interval; larger is more accurate but uses more memory")
+)
+
+// Summary counts CLIENT_QUERY and CLIENT_RESPONSE messages over an interval.
+// Top lists are estimates; see topk.Entry.
+type Summary struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Queries   uint64    `json:"queries"`
+	Responses uint64    `json:"responses"`
+
+	TopQNames  []topk.Entry `json:"top_qnames"`
+	TopClients []topk.Entry `json:"top_clients"`
+	// TopNXDomainClients are the clients receiving the most NXDOMAIN
+	// responses.
+	TopNXDomainClients []topk.Entry `json:"top_nxdomain_clients"`
+	QTypes             []topk.Entry `json:"qtypes"`
+	Rcodes             []topk.Entry `json:"rcodes"`
+}
+
+// summariser accumulates Summaries and publishes them every interval.
+type summariser struct {
+	pub      *pub.Publisher
+	redact   *redact.Redactor
+	interval time.Duration
+	top      int
+
+	mu                 sync.Mutex
+	start, last        time.Time
+	queries, responses uint64
+	qnames, clients    *topk.Sketch
+	nxdomain           *topk.Sketch
+	qtypes, rcodes     *topk.Sketch
+}
+
+func newSummariser(p *pub.Publisher, r *redact.Redactor, interval time.Duration, top, capacity int) *summariser {
+	s := &summariser{
+		pub:      p,
+		redact:   r,
+		interval: interval,
+		top:      top,
+		qnames:   topk.New(capacity),
+		clients:  topk.New(capacity),
+		nxdomain: topk.New(capacity),
+		// there are few enough of these to count exactly
+		qtypes: topk.New(1 << 16),
+		rcodes: topk.New(1 << 12),
+	}
+	if !messageTime {
+		// otherwise the first interval starts with the first message
+		s.start = time.Now()
+	}
+	return s
+}
+
+func (s *summariser) process(dt *DNSTap) {
+	if messageTime {
+		for _, sum := range s.advance(timeOf(dt)) {
+			s.publish(sum)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if messageTime {
+		s.last = timeOf(dt)
+	}
+	switch dt.Type {
+	case "CLIENT_QUERY":
+		s.queries++
+		s.clients.Add(dt.QueryAddress, 1)
+		if len(dt.Message.Question) > 0 {
+			q := dt.Message.Question[0]
+			s.qnames.Add(strings.ToLower(q.Name), 1)
+			s.qtypes.Add(typeName(q.Qtype), 1)
+		}
+	case "CLIENT_RESPONSE":
+		s.responses++
+		s.rcodes.Add(rcodeName(dt.Message.Rcode), 1)
+		if dt.Message.Rcode == dns.RcodeNameError {
+			s.nxdomain.Add(dt.QueryAddress, 1)
+		}
+	}
+}
+
+// run publishes a Summary every interval.
+func (s *summariser) run() {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for now := range t.C {
+		s.publish(s.summarise(now))
+	}
+}
+
+// advance returns the Summaries of intervals ending at or before now, in
+// message time. Empty intervals, such as gaps between captures, are skipped.
+func (s *summariser) advance(now time.Time) []*Summary {
+	var sums []*Summary
+	for {
+		s.mu.Lock()
+		if s.start.IsZero() {
+			s.start = now
+		}
+		end := s.start.Add(s.interval)
+		if now.Before(end) {
+			s.mu.Unlock()
+			return sums
+		}
+		if s.queries == 0 && s.responses == 0 {
+			s.start = end.Add(now.Sub(end).Truncate(s.interval))
+			s.mu.Unlock()
+			continue
+		}
+		s.mu.Unlock()
+		sums = append(sums, s.summarise(end))
+	}
+}
+
+// flush publishes the Summary of the last, incomplete, interval, ending at
+// the last message.
+func (s *summariser) flush() {
+	s.mu.Lock()
+	last := s.last
+	s.mu.Unlock()
+	if last.IsZero() {
+		return
+	}
+	s.publish(s.summarise(last))
+}
+
+func (s *summariser) publish(sum *Summary) {
+	out, err := encode(s.redact, sum)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	s.pub.Go(*summaryTopic, out)
+}
+
+// summarise returns the Summary of the interval ending now, and starts a new
+// interval.
+func (s *summariser) summarise(now time.Time) *Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := &Summary{
+		Start:              s.start,
+		End:                now,
+		Queries:            s.queries,
+		Responses:          s.responses,
+		TopQNames:          s.qnames.Top(s.top),
+		TopClients:         s.clients.Top(s.top),
+		TopNXDomainClients: s.nxdomain.Top(s.top),
+		QTypes:             s.qtypes.Top(1 << 16),
+		Rcodes:             s.rcodes.Top(1 << 12),
+	}
+	s.start, s.queries, s.responses = now, 0, 0
+	for _, sk := range []*topk.Sketch{s.qnames, s.clients, s.nxdomain, s.qtypes, s.rcodes} {
+		sk.Reset()
+	}
+	return sum
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummariser_MessageTime(t *testing.T) {
+	messageTime = true
+	t.Cleanup(func() { messageTime = false })
+
+	s := newSummariser(nil, nil, time.Minute, 10, 100)
+	start := time.Date(2019, 1, 1, 0, 0, 30, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		ts := start.Add(time.Duration(i) * 10 * time.Second)
+		if got := s.advance(ts); len(got) != 0 {
+			t.Fatalf("advance(%v) = %v; want nothing", ts, got)
+		}
+		s.last = ts
+		s.queries++
+	}
+	// an hour later, the first interval is complete and the empty ones
+	// between are skipped
+	later := start.Add(time.Hour + 5*time.Second)
+	got := s.advance(later)
+	if len(got) != 1 {
+		t.Fatalf("advance(%v) = %v; want one summary", later, got)
+	}
+	if got[0].Queries != 3 || !got[0].Start.Equal(start) || !got[0].End.Equal(start.Add(time.Minute)) {
+		t.Errorf("summary = %+v; want 3 queries in the minute from %v", got[0], start)
+	}
+	if want := start.Add(time.Hour); !s.start.Equal(want) {
+		t.Errorf("next interval starts at %v; want %v", s.start, want)
+	}
+}
+
+func TestPairer_MessageTime(t *testing.T) {
+	messageTime = true
+	t.Cleanup(func() { messageTime = false })
+
+	ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := timeOf(clientMsg("CLIENT_QUERY", 5353, 1, ts)); !got.Equal(ts) {
+		t.Errorf("timeOf() = %v; want message time %v", got, ts)
+	}
+	pr := newPairer(nil, nil, time.Second, 10)
+	pr.add(clientMsg("CLIENT_QUERY", 5353, 1, ts), ts)
+	pr.add(clientMsg("CLIENT_QUERY", 5354, 1, ts), ts)
+	got := pr.drain()
+	if len(got) != 2 || got[0].Answered || got[1].Answered {
+		t.Fatalf("drain() = %v; want two unanswered queries", got)
+	}
+	if pr.queue.Len() != 0 || len(pr.byKey) != 0 {
+		t.Errorf("%d queries outstanding after drain(); want none", pr.queue.Len())
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	suspicion          = flag.Bool("suspicion", false, "score messages for signs of DNS tunnelling and generated domains")
+	suspicionWindow    = flag.Duration("suspicion_window", 5*time.Minute, "window over which to count subdomains, TXT/NULL queries and client scores")
+	suspicionAlert     = flag.Float64("suspicion_alert_threshold", 50, "total score of a client's queries to one zone within a window that triggers an alert")
+	suspicionSubs      = flag.Int("suspicion_subdomains", 100, "distinct subdomains of a zone within a window considered suspicious")
+	suspicionTXT       = flag.Int("suspicion_txt_queries", 30, "TXT/NULL queries by a client within a window considered suspicious")
+	suspicionMaxTracks = flag.Int("suspicion_max_tracked", 10000, "maximum number of zones, clients and client/zone pairs to track per window")
+	alertTopic         = flag.String("mqtt_topic_alert", "dnstap/alert/json", "MQTT topic to publish suspicion alerts")
+
+	alertCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "dnstap",
+		Name:      "suspicion_alerts",
+		Help:      "count of suspicion alerts raised",
+	})
+	suspicionReasons = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dnstap",
+		Name:      "suspicion_reasons",
+		Help:      "count of client queries scored as suspicious, by reason",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(alertCount)
+	prometheus.MustRegister(suspicionReasons)
+}
+
+// Scores for each heuristic. A message's suspicion is the sum of the scores
+// of the heuristics it trips.
+var reasonScores = map[string]float64{
+	"long-label":     1,
+	"long-name":      1,
+	"high-entropy":   2,
+	"consonant-run":  1,
+	"digit-heavy":    0.5,
+	"txt-null-rate":  1,
+	"many-subdomain": 2,
+}
+
+// Alert is raised when a client's queries to a zone accumulate too much
+// suspicion within a window.
+type Alert struct {
+	Client      string    `json:"client"`
+	Zone        string    `json:"zone"`
+	Score       float64   `json:"score"`
+	Queries     int       `json:"queries"`
+	Reasons     []string  `json:"reasons"`
+	WindowStart time.Time `json:"window_start"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+type clientZone struct {
+	client, zone string
+}
+
+type pairScore struct {
+	score   float64
+	queries int
+	reasons map[string]bool
+	alerted bool
+}
+
+// scorer annotates messages with a suspicion score and the reasons for it,
+// and raises Alerts.
+type scorer struct {
+	pub    *pub.Publisher
+	redact *redact.Redactor
+	window time.Duration
+	max    int
+
+	mu         sync.Mutex
+	start      time.Time
+	subdomains map[string]map[string]struct{}
+	txt        map[string]int
+	pairs      map[clientZone]*pairScore
+}
+
+func newScorer(p *pub.Publisher, r *redact.Redactor, window time.Duration, max int) *scorer {
+	s := &scorer{pub: p, redact: r, window: window, max: max}
+	s.reset(time.Time{})
+	if !messageTime {
+		// otherwise the first window starts with the first message
+		s.start = time.Now()
+	}
+	return s
+}
+
+func (s *scorer) reset(now time.Time) {
+	s.start = now
+	s.subdomains = make(map[string]map[string]struct{})
+	s.txt = make(map[string]int)
+	s.pairs = make(map[clientZone]*pairScore)
+}
+
+func (s *scorer) process(dt *DNSTap) {
+	if len(dt.Message.Question) == 0 {
+		return
+	}
+	q := dt.Message.Question[0]
+	qname := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+	zone := zoneOf(qname)
+	if zone == "" {
+		return
+	}
+	sub := strings.TrimSuffix(strings.TrimSuffix(qname, zone), ".")
+	reasons := nameReasons(qname, sub, zone)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := timeOf(dt); s.start.IsZero() || now.Sub(s.start) >= s.window {
+		s.reset(now)
+	}
+	query := dt.Type == "CLIENT_QUERY"
+	if query && sub != "" {
+		subs, ok := s.subdomains[zone]
+		if !ok && len(s.subdomains) < s.max {
+			subs = make(map[string]struct{})
+			s.subdomains[zone] = subs
+		}
+		if subs != nil && len(subs) < *suspicionSubs {
+			subs[sub] = struct{}{}
+		}
+	}
+	if len(s.subdomains[zone]) >= *suspicionSubs {
+		reasons = append(reasons, "many-subdomain")
+	}
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeNULL {
+		if _, ok := s.txt[dt.QueryAddress]; query && (ok || len(s.txt) < s.max) {
+			s.txt[dt.QueryAddress]++
+		}
+		if s.txt[dt.QueryAddress] >= *suspicionTXT {
+			reasons = append(reasons, "txt-null-rate")
+		}
+	}
+	if len(reasons) == 0 {
+		return
+	}
+	for _, r := range reasons {
+		dt.Suspicion += reasonScores[r]
+	}
+	dt.SuspicionReasons = reasons
+	if !query {
+		return
+	}
+	for _, r := range reasons {
+		suspicionReasons.WithLabelValues(r).Inc()
+	}
+	key := clientZone{dt.QueryAddress, zone}
+	ps, ok := s.pairs[key]
+	if !ok {
+		if len(s.pairs) >= s.max {
+			return
+		}
+		ps = &pairScore{reasons: make(map[string]bool)}
+		s.pairs[key] = ps
+	}
+	ps.score += dt.Suspicion
+	ps.queries++
+	for _, r := range reasons {
+		ps.reasons[r] = true
+	}
+	if ps.alerted || ps.score < *suspicionAlert {
+		return
+	}
+	ps.alerted = true
+	alertCount.Inc()
+	a := &Alert{
+		Client:      key.client,
+		Zone:        key.zone,
+		Score:       ps.score,
+		Queries:     ps.queries,
+		WindowStart: s.start,
+		Timestamp:   dt.Timestamp,
+	}
+	for r := range ps.reasons {
+		a.Reasons = append(a.Reasons, r)
+	}
+	sort.Strings(a.Reasons)
+	out, err := encode(s.redact, a)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	s.pub.Go(*alertTopic, out)
+}
+
+// zoneOf returns the zone to attribute qname to: its registered domain, or
+// its last two labels if it isn't under a public suffix.
+func zoneOf(qname string) string {
+	if d := registeredDomain(qname); d != "" {
+		return d
+	}
+	if strings.HasSuffix(qname, ".arpa") {
+		return ""
+	}
+	labels := strings.Split(qname, ".")
+	if len(labels) < 2 {
+		return qname
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// nameReasons returns the heuristics that qname trips on its own. sub is the
+// part of qname below zone.
+func nameReasons(qname, sub, zone string) []string {
+	var reasons []string
+	for _, l := range strings.Split(qname, ".") {
+		if len(l) > 40 {
+			reasons = append(reasons, "long-label")
+			break
+		}
+	}
+	if len(qname) > 100 {
+		reasons = append(reasons, "long-name")
+	}
+	if s := strings.Replace(sub, ".", "", -1); len(s) >= 16 && entropy(s) >= 4 {
+		reasons = append(reasons, "high-entropy")
+	}
+	// generated domains register random-looking second-level labels
+	label := strings.SplitN(zone, ".", 2)[0]
+	if consonantRun(label) >= 5 {
+		reasons = append(reasons, "consonant-run")
+	}
+	if len(label) >= 8 && digitRatio(label) > 0.3 {
+		reasons = append(reasons, "digit-heavy")
+	}
+	return reasons
+}
+
+// entropy returns the Shannon entropy of s, in bits per character.
+func entropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	var h float64
+	n := float64(len(s))
+	for _, c := range counts {
+		p := float64(c) / n
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// consonantRun returns the length of the longest run of consecutive
+// consonants in s.
+func consonantRun(s string) int {
+	longest, run := 0, 0
+	for _, r := range s {
+		if r >= 'a' && r <= 'z' && !strings.ContainsRune("aeiouy", r) {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	return longest
+}
+
+// digitRatio returns the proportion of s that is digits.
+func digitRatio(s string) float64 {
+	digits := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	return float64(digits) / float64(len(s))
+}
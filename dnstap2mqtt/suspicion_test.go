@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNameReasons(t *testing.T) {
+	for _, tc := range []struct {
+		qname, sub, zone string
+		want             []string
+	}{
+		{"www.example.com", "www", "example.com", nil},
+		{"mail.google.com", "mail", "google.com", nil},
+		{"xkcdqrtzvb.com", "", "xkcdqrtzvb.com", []string{"consonant-run"}},
+		{"a8f3k29d7s1.net", "", "a8f3k29d7s1.net", []string{"digit-heavy"}},
+		{
+			"dGhpcyBpcyBhIHNlY3JldCBtZXNzYWdlIGV4ZmlsdHJhdGVk.t.example.com",
+			"dGhpcyBpcyBhIHNlY3JldCBtZXNzYWdlIGV4ZmlsdHJhdGVk.t",
+			"example.com",
+			[]string{"long-label", "high-entropy"},
+		},
+	} {
+		got := nameReasons(tc.qname, tc.sub, tc.zone)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("nameReasons(%q) = %v; want %v", tc.qname, got, tc.want)
+		}
+	}
+}
+
+func TestScorer_Subdomains(t *testing.T) {
+	subs, alert := *suspicionSubs, *suspicionAlert
+	t.Cleanup(func() { *suspicionSubs, *suspicionAlert = subs, alert })
+	*suspicionSubs = 10
+	*suspicionAlert = 15
+	s := newScorer(nil, nil, time.Hour, 100)
+	var last *DNSTap
+	for i := 0; i < 10; i++ {
+		dt := &DNSTap{Type: "CLIENT_QUERY", QueryAddress: "192.168.8.68"}
+		dt.Message.Question = []dns.Question{{Name: fmt.Sprintf("q%d.tunnel.test.", i), Qtype: dns.TypeA}}
+		s.process(dt)
+		last = dt
+	}
+	if want, got := 2.0, last.Suspicion; want != got {
+		t.Errorf("Suspicion = %f; want %f (%v)", got, want, last.SuspicionReasons)
+	}
+	ps := s.pairs[clientZone{"192.168.8.68", "tunnel.test"}]
+	if ps == nil || ps.score != 2 {
+		t.Fatalf("pair score = %+v; want 2", ps)
+	}
+}
@@ -0,0 +1,253 @@
+// Package enrich looks up the country, city and autonomous system of IP
+// addresses in local MaxMind (MMDB) and ip2asn (TSV) databases.
+package enrich
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	register sync.Once
+
+	lookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "enrich",
+		Name:      "lookups",
+		Help:      "count of address lookups",
+	}, []string{"result"})
+)
+
+// Info is what is known about an address. Fields are empty if unknown.
+type Info struct {
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+	ASN     uint32 `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// merge fills the empty fields of i from o.
+func (i *Info) merge(o Info) {
+	if i.Country == "" {
+		i.Country = o.Country
+	}
+	if i.City == "" {
+		i.City = o.City
+	}
+	if i.ASN == 0 {
+		i.ASN, i.ASOrg = o.ASN, o.ASOrg
+	}
+}
+
+// A database maps addresses to Info.
+type database interface {
+	lookup(ip net.IP) (Info, bool, error)
+	close() error
+}
+
+// open opens the database at path: MMDB if it ends in .mmdb, and ip2asn TSV,
+// optionally gzipped, otherwise.
+func open(path string) (database, error) {
+	if strings.HasSuffix(path, ".mmdb") {
+		return openMMDB(path)
+	}
+	return loadTSV(path)
+}
+
+type file struct {
+	path    string
+	modTime time.Time
+	size    int64
+	db      database
+}
+
+// read reopens the file if it has changed since it was last opened,
+// returning a nil database if it hasn't.
+func (f *file) read() (database, os.FileInfo, error) {
+	st, err := os.Stat(f.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.db != nil && st.ModTime().Equal(f.modTime) && st.Size() == f.size {
+		return nil, st, nil
+	}
+	db, err := open(f.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, st, nil
+}
+
+// Enricher looks addresses up in a list of databases, caching the most
+// recent results. Databases earlier in the list take precedence, and later
+// ones fill in what they don't know. It is safe for concurrent use.
+type Enricher struct {
+	// loading serialises Reload and Close, which alone modify files.
+	loading sync.Mutex
+	mu      sync.RWMutex
+	files   []*file
+	cache   *cache
+}
+
+// Open returns an Enricher for the databases at paths, caching up to
+// cacheSize addresses.
+func Open(paths []string, cacheSize int) (*Enricher, error) {
+	register.Do(func() {
+		prometheus.MustRegister(lookups)
+	})
+	e := &Enricher{cache: newCache(cacheSize)}
+	for _, p := range paths {
+		f := &file{path: p}
+		db, st, err := f.read()
+		if err != nil {
+			e.Close()
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		f.db, f.modTime, f.size = db, st.ModTime(), st.Size()
+		e.files = append(e.files, f)
+	}
+	return e, nil
+}
+
+// Reload reopens any databases that have changed, and empties the cache if
+// there were any. Databases that fail to open are left as they were; their
+// errors are returned. Lookups continue while databases are opened.
+func (e *Enricher) Reload() (reloaded []string, errs []error) {
+	e.loading.Lock()
+	defer e.loading.Unlock()
+	e.mu.RLock()
+	files := append([]*file(nil), e.files...)
+	e.mu.RUnlock()
+	for _, f := range files {
+		db, st, err := f.read()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", f.path, err))
+			continue
+		}
+		if db == nil {
+			continue
+		}
+		e.mu.Lock()
+		old := f.db
+		f.db, f.modTime, f.size = db, st.ModTime(), st.Size()
+		// no lookup can be using the old database, or caching its results
+		old.close()
+		e.cache.purge()
+		e.mu.Unlock()
+		reloaded = append(reloaded, f.path)
+	}
+	return reloaded, errs
+}
+
+// Lookup returns what is known about ip, and whether anything is. Private,
+// loopback and other non-global addresses aren't looked up.
+func (e *Enricher) Lookup(ip net.IP) (Info, bool) {
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		lookups.WithLabelValues("skipped").Inc()
+		return Info{}, false
+	}
+	key := string(ip.To16())
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if info, ok := e.cache.get(key); ok {
+		lookups.WithLabelValues("cached").Inc()
+		return info, info != Info{}
+	}
+	var info Info
+	for _, f := range e.files {
+		i, ok, err := f.db.lookup(ip)
+		if err != nil {
+			lookups.WithLabelValues("error").Inc()
+			continue
+		}
+		if ok {
+			info.merge(i)
+		}
+	}
+	e.cache.add(key, info)
+	if info == (Info{}) {
+		lookups.WithLabelValues("miss").Inc()
+		return info, false
+	}
+	lookups.WithLabelValues("hit").Inc()
+	return info, true
+}
+
+// Close closes the databases.
+func (e *Enricher) Close() error {
+	e.loading.Lock()
+	defer e.loading.Unlock()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var first error
+	for _, f := range e.files {
+		if f.db == nil {
+			continue
+		}
+		if err := f.db.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// cache is a least-recently-used cache of lookup results, holding at most
+// size of them.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	info Info
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *cache) get(key string) (Info, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return Info{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).info, true
+}
+
+func (c *cache) add(key string, info Info) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cacheEntry).info = info
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, info})
+	if c.order.Len() > c.size {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *cache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
@@ -0,0 +1,124 @@
+package enrich
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const asns = `1.0.0.0	1.0.0.255	13335	US	CLOUDFLARENET
+1.0.1.0	1.0.3.255	0	None	Not routed
+8.8.8.0	8.8.8.255	15169	US	GOOGLE
+2001:4860::	2001:4860:ffff:ffff:ffff:ffff:ffff:ffff	15169	US	GOOGLE
+`
+
+func TestParseTSV(t *testing.T) {
+	db, err := parseTSV(strings.NewReader(asns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ip   string
+		want Info
+		ok   bool
+	}{
+		{"1.0.0.1", Info{Country: "US", ASN: 13335, ASOrg: "CLOUDFLARENET"}, true},
+		{"1.0.0.255", Info{Country: "US", ASN: 13335, ASOrg: "CLOUDFLARENET"}, true},
+		{"1.0.2.1", Info{}, false},
+		{"8.8.4.4", Info{}, false},
+		{"8.8.8.8", Info{Country: "US", ASN: 15169, ASOrg: "GOOGLE"}, true},
+		{"2001:4860:4860::8888", Info{Country: "US", ASN: 15169, ASOrg: "GOOGLE"}, true},
+		{"0.0.0.1", Info{}, false},
+		{"2a00::1", Info{}, false},
+	} {
+		got, ok, err := db.lookup(net.ParseIP(c.ip))
+		if err != nil || got != c.want || ok != c.ok {
+			t.Errorf("lookup(%s) = %+v, %v, %v; want %+v, %v", c.ip, got, ok, err, c.want, c.ok)
+		}
+	}
+	if _, err := parseTSV(strings.NewReader("1.0.0.0\t1.0.0.255\t13335\n")); err == nil {
+		t.Error("short line accepted")
+	}
+	if _, err := parseTSV(strings.NewReader("1.0.0.255\t1.0.0.0\t13335\tUS\tX\n")); err == nil {
+		t.Error("backwards range accepted")
+	}
+}
+
+func TestEnricher(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.tsv"), filepath.Join(dir, "second.tsv")
+	write := func(path, content string, mtime time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write(first, "8.8.8.0\t8.8.8.255\t15169\tNone\tGOOGLE\n", now)
+	write(second, asns, now)
+	e, err := Open([]string{first, second}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	// the first file's AS and the second's country
+	want := Info{Country: "US", ASN: 15169, ASOrg: "GOOGLE"}
+	for i := 0; i < 2; i++ {
+		if got, ok := e.Lookup(net.ParseIP("8.8.8.8")); !ok || got != want {
+			t.Errorf("Lookup(8.8.8.8) = %+v, %v; want %+v", got, ok, want)
+		}
+	}
+	if _, ok := e.cache.get(string(net.ParseIP("8.8.8.8"))); !ok {
+		t.Error("8.8.8.8 not cached")
+	}
+	if got, ok := e.Lookup(net.ParseIP("192.168.1.1")); ok {
+		t.Errorf("Lookup(192.168.1.1) = %+v; want nothing", got)
+	}
+
+	if reloaded, errs := e.Reload(); len(reloaded) != 0 || len(errs) != 0 {
+		t.Errorf("Reload() of unchanged files = %v, %v", reloaded, errs)
+	}
+	write(first, "8.8.8.0\t8.8.8.255\t64496\tNone\tEXAMPLE\n", now.Add(time.Minute))
+	if reloaded, errs := e.Reload(); len(reloaded) != 1 || reloaded[0] != first || len(errs) != 0 {
+		t.Errorf("Reload() = %v, %v; want [%s]", reloaded, errs, first)
+	}
+	want = Info{Country: "US", ASN: 64496, ASOrg: "EXAMPLE"}
+	if got, _ := e.Lookup(net.ParseIP("8.8.8.8")); got != want {
+		t.Errorf("Lookup(8.8.8.8) after reload = %+v; want %+v", got, want)
+	}
+
+	// a broken file keeps the previous database
+	write(first, "garbage\n", now.Add(2*time.Minute))
+	if _, errs := e.Reload(); len(errs) != 1 {
+		t.Errorf("Reload() of broken file returned %v", errs)
+	}
+	if got, _ := e.Lookup(net.ParseIP("8.8.8.8")); got != want {
+		t.Errorf("Lookup(8.8.8.8) after failed reload = %+v; want %+v", got, want)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := newCache(2)
+	c.add("a", Info{ASN: 1})
+	c.add("b", Info{ASN: 2})
+	c.get("a")
+	c.add("c", Info{ASN: 3})
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used entry not evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.get(k); !ok {
+			t.Errorf("%s evicted", k)
+		}
+	}
+	c.purge()
+	if _, ok := c.get("a"); ok {
+		t.Error("purge left entries")
+	}
+}
@@ -0,0 +1,50 @@
+package enrich
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbRecord holds the fields of the GeoIP2/GeoLite2 City, Country and ASN
+// databases that make up an Info.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN   uint32 `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+type mmdb struct {
+	r *maxminddb.Reader
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mmdb{r}, nil
+}
+
+func (m *mmdb) lookup(ip net.IP) (Info, bool, error) {
+	var rec mmdbRecord
+	_, ok, err := m.r.LookupNetwork(ip, &rec)
+	if !ok || err != nil {
+		return Info{}, false, err
+	}
+	return Info{
+		Country: rec.Country.ISOCode,
+		City:    rec.City.Names["en"],
+		ASN:     rec.ASN,
+		ASOrg:   rec.ASOrg,
+	}, true, nil
+}
+
+func (m *mmdb) close() error {
+	return m.r.Close()
+}
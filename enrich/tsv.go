@@ -0,0 +1,101 @@
+package enrich
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ipRange is a line of an ip2asn TSV file. Addresses are 16 bytes long.
+type ipRange struct {
+	start, end net.IP
+	info       Info
+}
+
+// tsv is an ip2asn database, from https://iptoasn.com/: tab-separated
+// lines of range start, range end, AS number, country code and AS
+// description. Ranges with AS number 0 are unrouted, and are skipped.
+type tsv struct {
+	ranges []ipRange // sorted by start
+}
+
+// loadTSV reads the ip2asn file at path, which is gunzipped if it ends in
+// .gz.
+func loadTSV(path string) (*tsv, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return parseTSV(r)
+}
+
+func parseTSV(r io.Reader) (*tsv, error) {
+	t := &tsv{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("line %d: want 5 fields, got %d", n, len(fields))
+		}
+		start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+			return nil, fmt.Errorf("line %d: invalid range %s-%s", n, fields[0], fields[1])
+		}
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if asn == 0 {
+			continue
+		}
+		info := Info{ASN: uint32(asn), ASOrg: fields[4]}
+		if c := fields[3]; c != "None" && c != "Unknown" {
+			info.Country = c
+		}
+		t.ranges = append(t.ranges, ipRange{start.To16(), end.To16(), info})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(t.ranges, func(i, j int) bool {
+		return bytes.Compare(t.ranges[i].start, t.ranges[j].start) < 0
+	})
+	return t, nil
+}
+
+func (t *tsv) lookup(ip net.IP) (Info, bool, error) {
+	ip = ip.To16()
+	// the last range starting at or before ip
+	i := sort.Search(len(t.ranges), func(i int) bool {
+		return bytes.Compare(t.ranges[i].start, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, t.ranges[i].end) > 0 {
+		return Info{}, false, nil
+	}
+	return t.ranges[i].info, true, nil
+}
+
+func (t *tsv) close() error {
+	return nil
+}
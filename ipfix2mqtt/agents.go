@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/bio-routing/tflow2/config"
+	"github.com/bio-routing/tflow2/srcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var agentFlows = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "ipfix",
+	Name:      "agent_flows",
+	Help:      "count of flows from each agent, by result",
+}, []string{"agent", "result"})
+
+func init() {
+	prometheus.MustRegister(agentFlows)
+}
+
+// unknownAgent is the agent label for flows from addresses not in the agents
+// file.
+const unknownAgent = "unknown"
+
+// Agent is a flow exporter, as configured in the agents file. In YAML:
+//
+//	# agents.yaml
+//	- name: gw
+//	  ip: 192.168.8.1
+//	  sample_rate: 1
+//	  site: home
+//	  interfaces:
+//	    1: wan
+//	    2: lan
+type Agent struct {
+	Name       string `json:"name" yaml:"name"`
+	IP         string `json:"ip" yaml:"ip"`
+	SampleRate uint64 `json:"sample_rate" yaml:"sample_rate"`
+	Site       string `json:"site" yaml:"site"`
+	// Interfaces maps SNMP interface indexes to names.
+	Interfaces map[uint32]string `json:"interfaces" yaml:"interfaces"`
+}
+
+// loadAgents reads a list of agents from a JSON file, if its name ends in
+// .json, or a YAML file otherwise.
+func loadAgents(path string) ([]Agent, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var agents []Agent
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(b, &agents)
+	} else {
+		err = yaml.UnmarshalStrict(b, &agents)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	seen := make(map[string]bool)
+	for i, a := range agents {
+		ip := net.ParseIP(a.IP)
+		switch {
+		case a.Name == "":
+			return nil, fmt.Errorf("%s: agent %d has no name", path, i)
+		case ip == nil:
+			return nil, fmt.Errorf("%s: agent %q has invalid ip %q", path, a.Name, a.IP)
+		case seen[ip.String()]:
+			return nil, fmt.Errorf("%s: agent %q has duplicate ip %s", path, a.Name, a.IP)
+		}
+		seen[ip.String()] = true
+		agents[i].IP = ip.String()
+		if a.SampleRate == 0 {
+			agents[i].SampleRate = 1
+		}
+	}
+	return agents, nil
+}
+
+// agentTable looks up agents by IP address. It is safe for concurrent use.
+type agentTable struct {
+	// fallback, if set, is returned for addresses not in the table.
+	fallback *Agent
+
+	mu   sync.RWMutex
+	byIP map[string]*Agent
+}
+
+func newAgentTable(agents []Agent) *agentTable {
+	t := &agentTable{}
+	t.set(agents)
+	return t
+}
+
+// set replaces the agents in the table.
+func (t *agentTable) set(agents []Agent) {
+	byIP := make(map[string]*Agent, len(agents))
+	for i := range agents {
+		byIP[agents[i].IP] = &agents[i]
+	}
+	t.mu.Lock()
+	t.byIP = byIP
+	t.mu.Unlock()
+}
+
+// lookup returns the agent with address ip, or the fallback if there is
+// none.
+func (t *agentTable) lookup(ip net.IP) *Agent {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if a, ok := t.byIP[ip.String()]; ok {
+		return a
+	}
+	return t.fallback
+}
+
+// all returns the agents in the table.
+func (t *agentTable) all() []Agent {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	agents := make([]Agent, 0, len(t.byIP))
+	for _, a := range t.byIP {
+		agents = append(agents, *a)
+	}
+	return agents
+}
+
+// watch reloads the table from path on SIGHUP. If the file can't be loaded,
+// the table is left unchanged.
+func (t *agentTable) watch(path string, sr *srcache.SamplerateCache, fixed map[string]string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		n, err := t.reload(path, sr, fixed)
+		if err != nil {
+			logrus.Errorf("not reloading agents: %v", err)
+			continue
+		}
+		logrus.Infof("reloaded %d agents from %s", n, path)
+	}
+}
+
+// reload replaces the table with the agents in path, and returns how many
+// there are.
+//
+// The tflow2 collector reads its agents only at startup, and can't safely
+// be changed while running. If fixed, its agents by IP, is non-nil, a file
+// adding agents to it is therefore rejected: NetFlow v9 agents can only be
+// added by restarting.
+func (t *agentTable) reload(path string, sr *srcache.SamplerateCache, fixed map[string]string) (int, error) {
+	agents, err := loadAgents(path)
+	if err != nil {
+		return 0, err
+	}
+	if fixed != nil {
+		var added []string
+		for _, a := range agents {
+			if _, ok := fixed[a.IP]; !ok {
+				added = append(added, fmt.Sprintf("%q (%s)", a.Name, a.IP))
+			}
+		}
+		if len(added) > 0 {
+			return 0, fmt.Errorf("%s: adding agents %s needs a restart while NetFlow v9 is enabled", path, strings.Join(added, ", "))
+		}
+	}
+	for _, a := range agents {
+		sr.Set(net.ParseIP(a.IP), a.SampleRate)
+	}
+	t.set(agents)
+	return len(agents), nil
+}
+
+// tflow2Agents returns the agents in the form the tflow2 collector wants.
+func tflow2Agents(agents []Agent) ([]config.Agent, map[string]string) {
+	out := make([]config.Agent, 0, len(agents))
+	nameByIP := make(map[string]string, len(agents))
+	for _, a := range agents {
+		out = append(out, config.Agent{Name: a.Name, IPAddress: a.IP, SampleRate: a.SampleRate})
+		nameByIP[a.IP] = a.Name
+	}
+	return out, nameByIP
+}
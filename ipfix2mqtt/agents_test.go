@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bio-routing/tflow2/srcache"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadAgents(t *testing.T) {
+	for name, content := range map[string]string{
+		"agents.yaml": `
+- name: gw
+  ip: 192.168.8.1
+  site: home
+  interfaces:
+    1: wan
+    2: lan
+- name: switch
+  ip: "2001:db8::1"
+  sample_rate: 512
+`,
+		"agents.json": `[
+  {"name": "gw", "ip": "192.168.8.1", "site": "home", "interfaces": {"1": "wan", "2": "lan"}},
+  {"name": "switch", "ip": "2001:db8:0::1", "sample_rate": 512}
+]`,
+	} {
+		agents, err := loadAgents(writeFile(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		table := newAgentTable(agents)
+		gw := table.lookup(net.ParseIP("192.168.8.1"))
+		if gw == nil || gw.Name != "gw" || gw.Site != "home" || gw.SampleRate != 1 || gw.Interfaces[2] != "lan" {
+			t.Errorf("%s: gw = %+v", name, gw)
+		}
+		sw := table.lookup(net.ParseIP("2001:db8::1"))
+		if sw == nil || sw.Name != "switch" || sw.SampleRate != 512 {
+			t.Errorf("%s: switch = %+v", name, sw)
+		}
+		if a := table.lookup(net.ParseIP("192.168.8.2")); a != nil {
+			t.Errorf("%s: unknown agent = %+v; want nil", name, a)
+		}
+	}
+}
+
+func TestLoadAgents_Errors(t *testing.T) {
+	for _, content := range []string{
+		"- ip: 192.168.8.1",
+		"- name: gw\n  ip: gw.local",
+		"- name: gw\n  ip: 192.168.8.1\n- name: gw2\n  ip: 192.168.8.1",
+		"- name: gw\n  ip: 192.168.8.1\n  sampling: 1",
+	} {
+		if _, err := loadAgents(writeFile(t, "agents.yaml", content)); err == nil {
+			t.Errorf("loadAgents(%q) succeeded; want error", content)
+		}
+	}
+}
+
+func TestAgentTable_Fallback(t *testing.T) {
+	table := newAgentTable(nil)
+	table.fallback = &Agent{Name: "agent"}
+	if a := table.lookup(net.ParseIP("192.168.8.1")); a == nil || a.Name != "agent" {
+		t.Errorf("lookup() = %+v; want fallback", a)
+	}
+}
+
+func TestAgentTable_Reload(t *testing.T) {
+	table := newAgentTable([]Agent{{Name: "gw", IP: "192.168.8.1", SampleRate: 1}})
+	_, fixed := tflow2Agents(table.all())
+	path := writeFile(t, "agents.yaml", "- name: gw\n  ip: 192.168.8.1\n- name: switch\n  ip: 192.168.8.2\n")
+	// NetFlow v9 can't accept the new agent
+	if _, err := table.reload(path, srcache.New(nil), fixed); err == nil {
+		t.Error("reload() adding an agent succeeded")
+	}
+	if a := table.lookup(net.ParseIP("192.168.8.2")); a != nil {
+		t.Errorf("lookup() after rejected reload = %+v; want nil", a)
+	}
+	if n, err := table.reload(path, srcache.New(nil), nil); n != 2 || err != nil {
+		t.Errorf("reload() = %d, %v; want 2 agents", n, err)
+	}
+	if a := table.lookup(net.ParseIP("192.168.8.2")); a == nil || a.Name != "switch" {
+		t.Errorf("lookup() after reload = %+v; want switch", a)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
+	"github.com/dichro/pubsub-logging/topk"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	aggInterval = flag.Duration("aggregate_interval", 0, "length of the windows to aggregate flows over, or 0 to disable")
+	aggKeys     = flag.String("aggregate_keys", "agent,src_addr,dst_addr,protocol", "comma-separated fields to group flows by: agent, if_in, if_out, src_addr, dst_addr, src_net, dst_net, src_port, dst_port, protocol, direction, src_device, dst_device")
+	aggV4Prefix = flag.Int("aggregate_ipv4_prefix", 24, "length of the IPv4 prefixes that src_net and dst_net group by")
+	aggV6Prefix = flag.Int("aggregate_ipv6_prefix", 48, "length of the IPv6 prefixes that src_net and dst_net group by")
+	aggMaxKeys  = flag.Int("aggregate_max_keys", 100000, "number of groups to track per window; flows in further groups are counted in an overflow group")
+	aggTopic    = flag.String("mqtt_topic_aggregate", "ipfix/aggregate/json", "MQTT topic to publish aggregated flows")
+	topTopic    = flag.String("mqtt_topic_top", "ipfix/top/json", "MQTT topic to publish the top talkers in each aggregation window, or empty to disable")
+	topN        = flag.Int("aggregate_top", 10, "number of top talkers to publish per window")
+	topCapacity = flag.Int("aggregate_top_capacity", 1000, "number of talkers to track per window; larger is more accurate but uses more memory")
+)
+
+// aggKey is the group a flow is aggregated into. Fields not being grouped
+// by are left empty.
+type aggKey struct {
+	Agent        string `json:"agent,omitempty"`
+	InterfaceIn  string `json:"if_in,omitempty"`
+	InterfaceOut string `json:"if_out,omitempty"`
+	SrcAddr      string `json:"src_addr,omitempty"`
+	DstAddr      string `json:"dst_addr,omitempty"`
+	SrcNet       string `json:"src_net,omitempty"`
+	DstNet       string `json:"dst_net,omitempty"`
+	SrcPort      uint32 `json:"src_port,omitempty"`
+	DstPort      uint32 `json:"dst_port,omitempty"`
+	Protocol     string `json:"protocol,omitempty"`
+	Direction    string `json:"direction,omitempty"`
+	SrcDevice    string `json:"src_device,omitempty"`
+	DstDevice    string `json:"dst_device,omitempty"`
+}
+
+// Aggregate is the total of the flows in a group over a window. Bytes and
+// packets are scaled by sampling rate.
+type Aggregate struct {
+	Start time.Time `json:"window_start"`
+	End   time.Time `json:"window_end"`
+	aggKey
+	// Overflow is set for the group of flows that didn't fit in
+	// --aggregate_max_keys.
+	Overflow bool   `json:"overflow,omitempty"`
+	Flows    uint64 `json:"flows"`
+	Bytes    uint64 `json:"bytes"`
+	Packets  uint64 `json:"packets"`
+}
+
+// TopTalkers are the addresses sending and receiving the most bytes over a
+// window. Counts are estimates; see topk.Entry.
+type TopTalkers struct {
+	Start        time.Time    `json:"window_start"`
+	End          time.Time    `json:"window_end"`
+	Bytes        uint64       `json:"bytes"`
+	Sources      []topk.Entry `json:"sources"`
+	Destinations []topk.Entry `json:"destinations"`
+}
+
+// keyFields sets the field of an aggKey named by each --aggregate_keys
+// value.
+var keyFields = map[string]func(k *aggKey, r *Record){
+	"agent":      func(k *aggKey, r *Record) { k.Agent = r.Agent },
+	"if_in":      func(k *aggKey, r *Record) { k.InterfaceIn = interfaceName(r.InterfaceIn, r.InterfaceInName) },
+	"if_out":     func(k *aggKey, r *Record) { k.InterfaceOut = interfaceName(r.InterfaceOut, r.InterfaceOutName) },
+	"src_addr":   func(k *aggKey, r *Record) { k.SrcAddr = r.SrcAddr },
+	"dst_addr":   func(k *aggKey, r *Record) { k.DstAddr = r.DstAddr },
+	"src_net":    func(k *aggKey, r *Record) { k.SrcNet = network(r.SrcAddr) },
+	"dst_net":    func(k *aggKey, r *Record) { k.DstNet = network(r.DstAddr) },
+	"src_port":   func(k *aggKey, r *Record) { k.SrcPort = r.SrcPort },
+	"dst_port":   func(k *aggKey, r *Record) { k.DstPort = r.DstPort },
+	"protocol":   func(k *aggKey, r *Record) { k.Protocol = r.Protocol },
+	"direction":  func(k *aggKey, r *Record) { k.Direction = r.Direction },
+	"src_device": func(k *aggKey, r *Record) { k.SrcDevice = r.SrcDevice },
+	"dst_device": func(k *aggKey, r *Record) { k.DstDevice = r.DstDevice },
+}
+
+func interfaceName(index uint32, name string) string {
+	if name != "" {
+		return name
+	}
+	return strconv.FormatUint(uint64(index), 10)
+}
+
+// network returns the prefix containing addr, of the length given by
+// --aggregate_ipv4_prefix or --aggregate_ipv6_prefix.
+func network(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	bits, size := *aggV6Prefix, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, size = ip4, *aggV4Prefix, 32
+	}
+	mask := net.CIDRMask(bits, size)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+type totals struct {
+	flows, bytes, packets uint64
+}
+
+// aggregator sums flows into groups and publishes them every interval.
+type aggregator struct {
+	pub    *pub.Publisher
+	redact *redact.Redactor
+	fields []func(k *aggKey, r *Record)
+
+	mu                    sync.Mutex
+	start                 time.Time
+	groups                map[aggKey]*totals
+	overflow              totals
+	sources, destinations *topk.Sketch
+}
+
+// newAggregator returns an aggregator grouping by keys, a comma-separated
+// list of keyFields.
+func newAggregator(p *pub.Publisher, r *redact.Redactor, keys string) (*aggregator, error) {
+	a := &aggregator{
+		pub:          p,
+		redact:       r,
+		start:        time.Now(),
+		groups:       make(map[aggKey]*totals),
+		sources:      topk.New(*topCapacity),
+		destinations: topk.New(*topCapacity),
+	}
+	for _, k := range strings.Split(keys, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		f, ok := keyFields[k]
+		if !ok {
+			return nil, fmt.Errorf("unknown aggregation key %q", k)
+		}
+		a.fields = append(a.fields, f)
+	}
+	return a, nil
+}
+
+func (a *aggregator) process(r *Record) {
+	var k aggKey
+	for _, f := range a.fields {
+		f(&k, r)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.groups[k]
+	if !ok {
+		if len(a.groups) < *aggMaxKeys {
+			t = &totals{}
+			a.groups[k] = t
+		} else {
+			t = &a.overflow
+		}
+	}
+	t.flows++
+	t.bytes += r.Bytes
+	t.packets += r.Packets
+	if r.SrcAddr != "" {
+		a.sources.Add(r.SrcAddr, r.Bytes)
+	}
+	if r.DstAddr != "" {
+		a.destinations.Add(r.DstAddr, r.Bytes)
+	}
+}
+
+// flush returns the aggregates and top talkers for the window ending now,
+// and starts a new window.
+func (a *aggregator) flush(now time.Time) ([]*Aggregate, *TopTalkers) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	aggs := make([]*Aggregate, 0, len(a.groups)+1)
+	for k, t := range a.groups {
+		aggs = append(aggs, &Aggregate{Start: a.start, End: now, aggKey: k, Flows: t.flows, Bytes: t.bytes, Packets: t.packets})
+	}
+	if a.overflow.flows > 0 {
+		o := a.overflow
+		aggs = append(aggs, &Aggregate{Start: a.start, End: now, Overflow: true, Flows: o.flows, Bytes: o.bytes, Packets: o.packets})
+	}
+	top := &TopTalkers{
+		Start:        a.start,
+		End:          now,
+		Bytes:        a.sources.Total(),
+		Sources:      a.sources.Top(*topN),
+		Destinations: a.destinations.Top(*topN),
+	}
+	a.start = now
+	a.groups = make(map[aggKey]*totals, len(a.groups))
+	a.overflow = totals{}
+	a.sources.Reset()
+	a.destinations.Reset()
+	return aggs, top
+}
+
+// run publishes aggregates every interval.
+func (a *aggregator) run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		aggs, top := a.flush(now)
+		for _, agg := range aggs {
+			a.publish(*aggTopic, agg)
+		}
+		if len(*topTopic) > 0 {
+			a.publish(*topTopic, top)
+		}
+	}
+}
+
+func (a *aggregator) publish(topic string, v interface{}) {
+	out, err := encode(a.redact, v)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	go a.pub.Publish(topic, out)
+}
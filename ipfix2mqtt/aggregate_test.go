@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAggregator(t *testing.T) {
+	a, err := newAggregator(nil, nil, "agent, src_net,dst_port,protocol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*Record{
+		{Agent: "gw", SrcAddr: "192.168.8.68", DstAddr: "1.1.1.1", DstPort: 53, Protocol: "udp", Bytes: 100, Packets: 1},
+		{Agent: "gw", SrcAddr: "192.168.8.69", DstAddr: "8.8.8.8", DstPort: 53, Protocol: "udp", Bytes: 200, Packets: 2},
+		{Agent: "gw", SrcAddr: "192.168.8.68", DstAddr: "1.1.1.1", DstPort: 443, Protocol: "tcp", Bytes: 5000, Packets: 5},
+		{Agent: "gw", SrcAddr: "2001:db8:1:2::1", DstAddr: "2001:db8:9::1", DstPort: 443, Protocol: "tcp", Bytes: 50, Packets: 1},
+	} {
+		a.process(r)
+	}
+	now := a.start.Add(time.Minute)
+	aggs, top := a.flush(now)
+	got := map[aggKey][3]uint64{}
+	for _, agg := range aggs {
+		if !agg.Start.Equal(now.Add(-time.Minute)) || !agg.End.Equal(now) || agg.Overflow {
+			t.Errorf("unexpected window or overflow: %+v", agg)
+		}
+		got[agg.aggKey] = [3]uint64{agg.Flows, agg.Bytes, agg.Packets}
+	}
+	want := map[aggKey][3]uint64{
+		{Agent: "gw", SrcNet: "192.168.8.0/24", DstPort: 53, Protocol: "udp"}:   {2, 300, 3},
+		{Agent: "gw", SrcNet: "192.168.8.0/24", DstPort: 443, Protocol: "tcp"}:  {1, 5000, 5},
+		{Agent: "gw", SrcNet: "2001:db8:1::/48", DstPort: 443, Protocol: "tcp"}: {1, 50, 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if top.Bytes != 5350 || len(top.Sources) != 3 || top.Sources[0].Key != "192.168.8.68" || top.Sources[0].Count != 5100 {
+		t.Errorf("unexpected sources: %+v", top)
+	}
+	if len(top.Destinations) == 0 || top.Destinations[0].Key != "1.1.1.1" {
+		t.Errorf("unexpected destinations: %+v", top.Destinations)
+	}
+
+	// the next window starts empty
+	if aggs, top := a.flush(now.Add(time.Minute)); len(aggs) != 0 || top.Bytes != 0 || !top.Start.Equal(now) {
+		t.Errorf("window not reset: %v %+v", aggs, top)
+	}
+}
+
+func TestAggregatorOverflow(t *testing.T) {
+	defer func(n int) { *aggMaxKeys = n }(*aggMaxKeys)
+	*aggMaxKeys = 1
+	a, err := newAggregator(nil, nil, "dst_addr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.process(&Record{DstAddr: "1.1.1.1", Bytes: 1})
+	a.process(&Record{DstAddr: "8.8.8.8", Bytes: 2})
+	a.process(&Record{DstAddr: "9.9.9.9", Bytes: 3})
+	aggs, _ := a.flush(time.Now())
+	if len(aggs) != 2 {
+		t.Fatalf("got %d aggregates, want 2", len(aggs))
+	}
+	if o := aggs[1]; !o.Overflow || o.Flows != 2 || o.Bytes != 5 || o.DstAddr != "" {
+		t.Errorf("unexpected overflow aggregate: %+v", o)
+	}
+}
+
+func TestAggregatorKeys(t *testing.T) {
+	if _, err := newAggregator(nil, nil, "src_addr,colour"); err == nil {
+		t.Error("unknown key accepted")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	biflowTopic   = flag.String("mqtt_topic_biflow", "", "MQTT topic to publish bidirectional flow records, or empty to disable")
+	biflowTimeout = flag.Duration("biflow_timeout", 30*time.Second, "how long to wait for the reverse of a flow before publishing it alone")
+	biflowMax     = flag.Int("biflow_max_pending", 100000, "maximum number of flows awaiting their reverse")
+
+	biflowCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "ipfix",
+		Name:      "biflows",
+		Help:      "count of bidirectional flow stitching outcomes",
+	}, []string{"result"})
+	biflowPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "ipfix",
+		Name:      "biflows_pending",
+		Help:      "count of flows awaiting their reverse",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(biflowCount)
+	prometheus.MustRegister(biflowPending)
+}
+
+// Endpoint is one end of a bidirectional flow, with the traffic it sent.
+type Endpoint struct {
+	Addr     string `json:"addr"`
+	Port     uint32 `json:"port,omitempty"`
+	Device   string `json:"device,omitempty"`
+	Internal bool   `json:"internal,omitempty"`
+	Country  string `json:"country,omitempty"`
+	AS       uint32 `json:"as,omitempty"`
+	ASOrg    string `json:"as_org,omitempty"`
+	Bytes    uint64 `json:"bytes"`
+	Packets  uint64 `json:"packets"`
+}
+
+// BiFlow is a flow and its reverse, from the endpoint that initiated the
+// connection to the one that responded.
+type BiFlow struct {
+	Timestamp time.Time `json:"timestamp"`
+	Agent     string    `json:"agent"`
+	Site      string    `json:"site,omitempty"`
+	Protocol  string    `json:"protocol"`
+	Service   string    `json:"service,omitempty"`
+	// Direction is from the initiator to the responder, relative to the
+	// local network, as for Record.
+	Direction string   `json:"direction,omitempty"`
+	Initiator Endpoint `json:"initiator"`
+	Responder Endpoint `json:"responder"`
+	// InitiatorBy is how the initiator was identified: "syn" from TCP
+	// flags, "port" from well-known or privileged ports, or "first" as the
+	// endpoint of the earlier flow. NetFlow v9 flows have no TCP flags, so
+	// are never identified by "syn".
+	InitiatorBy string     `json:"initiator_by"`
+	Start       *time.Time `json:"start,omitempty"`
+	End         *time.Time `json:"end,omitempty"`
+	Duration    float64    `json:"duration_seconds,omitempty"`
+	// Stitched is set if the reverse flow was seen.
+	Stitched bool `json:"stitched"`
+}
+
+type fiveTuple struct {
+	agent, protocol  string
+	srcAddr, dstAddr string
+	srcPort, dstPort uint32
+}
+
+func (k fiveTuple) reverse() fiveTuple {
+	k.srcAddr, k.dstAddr = k.dstAddr, k.srcAddr
+	k.srcPort, k.dstPort = k.dstPort, k.srcPort
+	return k
+}
+
+type halfFlow struct {
+	key     fiveTuple
+	flow    *Record
+	expires time.Time
+}
+
+// stitcher joins flows with their reverses, from the same agent, into
+// BiFlows. Flows wait for their reverses for a fixed time, in a cache of
+// bounded size; flows that time out or are evicted are published alone.
+// Further records for a waiting flow, such as from an exporter's active
+// timeout, are merged into it.
+type stitcher struct {
+	pub    *pub.Publisher
+	redact *redact.Redactor
+	ttl    time.Duration
+	max    int
+
+	mu    sync.Mutex
+	queue *list.List // of *halfFlow, oldest first
+	byKey map[fiveTuple]*list.Element
+}
+
+func newStitcher(p *pub.Publisher, r *redact.Redactor, ttl time.Duration, max int) *stitcher {
+	return &stitcher{
+		pub:    p,
+		redact: r,
+		ttl:    ttl,
+		max:    max,
+		queue:  list.New(),
+		byKey:  make(map[fiveTuple]*list.Element),
+	}
+}
+
+func (s *stitcher) process(r *Record) {
+	s.publish(s.add(r, time.Now()))
+}
+
+// run periodically publishes flows that have timed out.
+func (s *stitcher) run() {
+	interval := s.ttl / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for now := range t.C {
+		s.publish(s.expire(now))
+	}
+}
+
+func (s *stitcher) publish(flows []*BiFlow) {
+	for _, f := range flows {
+		out, err := encode(s.redact, f)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		go s.pub.Publish(*biflowTopic, out)
+	}
+}
+
+// add records a flow arriving at time now. It returns the BiFlow if r is
+// the reverse of a waiting flow, along with any flows evicted to make room.
+func (s *stitcher) add(r *Record, now time.Time) []*BiFlow {
+	key := fiveTuple{r.Agent, r.Protocol, r.SrcAddr, r.DstAddr, r.SrcPort, r.DstPort}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() { biflowPending.Set(float64(s.queue.Len())) }()
+	if e, ok := s.byKey[key.reverse()]; ok {
+		h := s.remove(e, "stitched")
+		return []*BiFlow{stitch(h.flow, r)}
+	}
+	if e, ok := s.byKey[key]; ok {
+		biflowCount.WithLabelValues("merged").Inc()
+		merge(e.Value.(*halfFlow).flow, r)
+		return nil
+	}
+	var evicted []*BiFlow
+	for s.max > 0 && s.queue.Len() >= s.max {
+		evicted = append(evicted, stitch(s.remove(s.queue.Front(), "evicted").flow, nil))
+	}
+	// other stages may hold on to r
+	flow := *r
+	flow.TCPFlags = append([]string(nil), r.TCPFlags...)
+	s.byKey[key] = s.queue.PushBack(&halfFlow{key: key, flow: &flow, expires: now.Add(s.ttl)})
+	return evicted
+}
+
+// expire removes and returns all flows that expired before now.
+func (s *stitcher) expire(now time.Time) []*BiFlow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []*BiFlow
+	for e := s.queue.Front(); e != nil && e.Value.(*halfFlow).expires.Before(now); e = s.queue.Front() {
+		expired = append(expired, stitch(s.remove(e, "unmatched").flow, nil))
+	}
+	biflowPending.Set(float64(s.queue.Len()))
+	return expired
+}
+
+// remove drops e from the cache, and returns it.
+func (s *stitcher) remove(e *list.Element, result string) *halfFlow {
+	h := s.queue.Remove(e).(*halfFlow)
+	delete(s.byKey, h.key)
+	biflowCount.WithLabelValues(result).Inc()
+	return h
+}
+
+// merge adds the counters and timespan of a later record for the same flow
+// into r.
+func merge(r, later *Record) {
+	r.Bytes += later.Bytes
+	r.Packets += later.Packets
+	r.TCPFlags = unionFlags(r.TCPFlags, later.TCPFlags)
+	if later.Start != nil && (r.Start == nil || later.Start.Before(*r.Start)) {
+		r.Start = later.Start
+	}
+	if later.End != nil && (r.End == nil || later.End.After(*r.End)) {
+		r.End = later.End
+	}
+	if r.Start != nil && r.End != nil {
+		r.Duration = r.End.Sub(*r.Start).Seconds()
+	}
+}
+
+func unionFlags(a, b []string) []string {
+	for _, f := range b {
+		if !hasFlag(a, f) {
+			a = append(a, f)
+		}
+	}
+	return a
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// stitch returns the BiFlow of a flow and its reverse, which may be nil.
+func stitch(first, reverse *Record) *BiFlow {
+	fromSrc, by := initiator(first, reverse)
+	b := &BiFlow{
+		Timestamp:   first.Timestamp,
+		Agent:       first.Agent,
+		Site:        first.Site,
+		Protocol:    first.Protocol,
+		Service:     first.Service,
+		InitiatorBy: by,
+		Start:       first.Start,
+		End:         first.End,
+		Stitched:    reverse != nil,
+	}
+	src, dst := endpoints(first)
+	src.Bytes, src.Packets = first.Bytes, first.Packets
+	if reverse != nil {
+		dst.Bytes, dst.Packets = reverse.Bytes, reverse.Packets
+		if reverse.Timestamp.Before(b.Timestamp) {
+			b.Timestamp = reverse.Timestamp
+		}
+		if reverse.Start != nil && (b.Start == nil || reverse.Start.Before(*b.Start)) {
+			b.Start = reverse.Start
+		}
+		if reverse.End != nil && (b.End == nil || reverse.End.After(*b.End)) {
+			b.End = reverse.End
+		}
+	}
+	if fromSrc {
+		b.Initiator, b.Responder = src, dst
+	} else {
+		b.Initiator, b.Responder = dst, src
+	}
+	if first.Direction != "" {
+		b.Direction = direction(b.Initiator.Internal, b.Responder.Internal)
+	}
+	if b.Start != nil && b.End != nil {
+		b.Duration = b.End.Sub(*b.Start).Seconds()
+	}
+	return b
+}
+
+// initiator reports whether the source of a, rather than of its reverse b
+// (which may be nil), initiated the connection, and how that was decided.
+func initiator(a, b *Record) (bool, string) {
+	if a.Protocol == "tcp" {
+		// a SYN without an ACK opens a connection; a SYN-ACK accepts it
+		aSyn, aAck := hasFlag(a.TCPFlags, "SYN"), hasFlag(a.TCPFlags, "ACK")
+		var bSyn, bAck bool
+		if b != nil {
+			bSyn, bAck = hasFlag(b.TCPFlags, "SYN"), hasFlag(b.TCPFlags, "ACK")
+		}
+		switch {
+		case aSyn && !aAck:
+			return true, "syn"
+		case bSyn && !bAck:
+			return false, "syn"
+		case b != nil && aSyn && !bSyn:
+			return true, "syn"
+		case bSyn && !aSyn:
+			return false, "syn"
+		}
+	}
+	if a.Protocol == "tcp" || a.Protocol == "udp" {
+		// connections are made from ephemeral ports to service ports
+		switch d := servicePort(a.DstPort) - servicePort(a.SrcPort); {
+		case d > 0:
+			return true, "port"
+		case d < 0:
+			return false, "port"
+		}
+	}
+	if b != nil && a.Start != nil && b.Start != nil && b.Start.Before(*a.Start) {
+		return false, "first"
+	}
+	return true, "first"
+}
+
+// servicePort ranks how likely port is to be a service's: 2 for well-known
+// services, 1 for other privileged ports and 0 otherwise.
+func servicePort(port uint32) int {
+	if _, ok := serviceNames[port]; ok {
+		return 2
+	}
+	if port > 0 && port < 1024 {
+		return 1
+	}
+	return 0
+}
+
+// endpoints returns the source and destination of r.
+func endpoints(r *Record) (src, dst Endpoint) {
+	src = Endpoint{
+		Addr:     r.SrcAddr,
+		Port:     r.SrcPort,
+		Device:   r.SrcDevice,
+		Internal: r.SrcInternal,
+		Country:  r.SrcCountry,
+		AS:       r.SrcAS,
+		ASOrg:    r.SrcASOrg,
+	}
+	dst = Endpoint{
+		Addr:     r.DstAddr,
+		Port:     r.DstPort,
+		Device:   r.DstDevice,
+		Internal: r.DstInternal,
+		Country:  r.DstCountry,
+		AS:       r.DstAS,
+		ASOrg:    r.DstASOrg,
+	}
+	return src, dst
+}
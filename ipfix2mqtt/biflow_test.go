@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStitcher(t *testing.T) {
+	now := time.Date(2020, 2, 17, 19, 52, 34, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	s := newStitcher(nil, nil, 30*time.Second, 10)
+
+	// the response is seen first; the SYN identifies the initiator
+	if got := s.add(&Record{
+		Agent: "gw", Protocol: "tcp", SrcAddr: "1.1.1.1", SrcPort: 8000, DstAddr: "192.168.8.68", DstPort: 50123,
+		SrcAS: 13335, DstInternal: true, DstDevice: "laptop", Direction: "inbound",
+		TCPFlags: []string{"SYN", "ACK"}, Bytes: 5000, Packets: 5, Start: at(time.Second), End: at(3 * time.Second),
+	}, now); len(got) != 0 {
+		t.Fatalf("unexpected biflows: %+v", got)
+	}
+	got := s.add(&Record{
+		Agent: "gw", Protocol: "tcp", SrcAddr: "192.168.8.68", SrcPort: 50123, DstAddr: "1.1.1.1", DstPort: 8000,
+		SrcInternal: true, SrcDevice: "laptop", DstAS: 13335, Direction: "outbound",
+		TCPFlags: []string{"SYN"}, Bytes: 100, Packets: 2, Start: at(0), End: at(2 * time.Second),
+	}, now)
+	if len(got) != 1 {
+		t.Fatalf("got %d biflows, want 1", len(got))
+	}
+	b := got[0]
+	if !b.Stitched || b.InitiatorBy != "syn" || b.Direction != "outbound" || b.Duration != 3 {
+		t.Errorf("unexpected biflow: %+v", b)
+	}
+	if i := b.Initiator; i.Addr != "192.168.8.68" || i.Port != 50123 || i.Device != "laptop" || !i.Internal || i.Bytes != 100 || i.Packets != 2 {
+		t.Errorf("unexpected initiator: %+v", i)
+	}
+	if r := b.Responder; r.Addr != "1.1.1.1" || r.Port != 8000 || r.AS != 13335 || r.Internal || r.Bytes != 5000 || r.Packets != 5 {
+		t.Errorf("unexpected responder: %+v", r)
+	}
+	if len(s.byKey) != 0 {
+		t.Errorf("stitched flows left waiting: %v", s.byKey)
+	}
+
+	// an unanswered DNS response, merged from two records
+	for i := 0; i < 2; i++ {
+		s.add(&Record{Agent: "gw", Protocol: "udp", SrcAddr: "8.8.8.8", SrcPort: 53, DstAddr: "192.168.8.68", DstPort: 40000, Bytes: 100, Packets: 1}, now)
+	}
+	if got := s.expire(now.Add(29 * time.Second)); len(got) != 0 {
+		t.Errorf("flows expired early: %+v", got)
+	}
+	got = s.expire(now.Add(31 * time.Second))
+	if len(got) != 1 {
+		t.Fatalf("got %d expired biflows, want 1", len(got))
+	}
+	b = got[0]
+	if b.Stitched || b.InitiatorBy != "port" || b.Initiator.Addr != "192.168.8.68" || b.Initiator.Bytes != 0 || b.Responder.Addr != "8.8.8.8" || b.Responder.Bytes != 200 || b.Responder.Packets != 2 {
+		t.Errorf("unexpected biflow: %+v", b)
+	}
+}
+
+func TestStitcherEviction(t *testing.T) {
+	s := newStitcher(nil, nil, time.Minute, 1)
+	now := time.Now()
+	s.add(&Record{Protocol: "udp", SrcAddr: "192.168.8.68", SrcPort: 40000, DstAddr: "8.8.8.8", DstPort: 53}, now)
+	got := s.add(&Record{Protocol: "udp", SrcAddr: "192.168.8.68", SrcPort: 40001, DstAddr: "8.8.8.8", DstPort: 53}, now)
+	if len(got) != 1 || got[0].Initiator.Port != 40000 || got[0].Stitched {
+		t.Errorf("unexpected evictions: %+v", got)
+	}
+	if s.queue.Len() != 1 {
+		t.Errorf("%d flows waiting, want 1", s.queue.Len())
+	}
+}
+
+func TestStitcherUnbounded(t *testing.T) {
+	s := newStitcher(nil, nil, time.Minute, 0)
+	now := time.Now()
+	for port := uint32(40000); port < 40003; port++ {
+		if got := s.add(&Record{Protocol: "udp", SrcAddr: "192.168.8.68", SrcPort: port, DstAddr: "8.8.8.8", DstPort: 53}, now); len(got) != 0 {
+			t.Errorf("unexpected evictions: %+v", got)
+		}
+	}
+	if s.queue.Len() != 3 {
+		t.Errorf("%d flows waiting, want 3", s.queue.Len())
+	}
+}
+
+func TestInitiator(t *testing.T) {
+	later := time.Time{}.Add(time.Second)
+	for _, c := range []struct {
+		name    string
+		a, b    *Record
+		fromSrc bool
+		by      string
+	}{
+		{"syn", &Record{Protocol: "tcp", SrcPort: 443, DstPort: 50000, TCPFlags: []string{"SYN"}}, nil, true, "syn"},
+		{"syn-ack", &Record{Protocol: "tcp", SrcPort: 50000, DstPort: 40000, TCPFlags: []string{"SYN", "ACK"}}, &Record{Protocol: "tcp", TCPFlags: []string{"SYN"}}, false, "syn"},
+		{"mid-stream", &Record{Protocol: "tcp", SrcPort: 50000, DstPort: 40000, TCPFlags: []string{"ACK"}}, &Record{Protocol: "tcp", TCPFlags: []string{"SYN", "ACK"}}, false, "syn"},
+		{"well-known port", &Record{Protocol: "tcp", SrcPort: 443, DstPort: 800, TCPFlags: []string{"SYN", "ACK"}}, nil, false, "port"},
+		{"privileged port", &Record{Protocol: "udp", SrcPort: 50000, DstPort: 999}, nil, true, "port"},
+		{"earlier", &Record{Protocol: "udp", SrcPort: 50000, DstPort: 40000, Start: &time.Time{}}, &Record{Protocol: "udp", Start: &time.Time{}}, true, "first"},
+		{"later", &Record{Protocol: "icmp", Start: &later}, &Record{Protocol: "icmp", Start: &time.Time{}}, false, "first"},
+	} {
+		fromSrc, by := initiator(c.a, c.b)
+		if fromSrc != c.fromSrc || by != c.by {
+			t.Errorf("%s: initiator() = %v, %q; want %v, %q", c.name, fromSrc, by, c.fromSrc, c.by)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package collector receives and decodes flow export protocols that the
+// tflow2 collector doesn't handle.
+package collector
+
+import (
+	"net"
+	"time"
+
+	"github.com/bio-routing/tflow2/netflow"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	packetCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "ipfix",
+		Name:      "packets",
+		Help:      "count of export packets received, by protocol and result",
+	}, []string{"protocol", "result"})
+	templateCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "ipfix",
+		Name:      "templates",
+		Help:      "count of cached templates",
+	}, []string{"protocol"})
+	templateEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "ipfix",
+		Name:      "template_events",
+		Help:      "count of template cache events: added, updated, withdrawn, expired, or missing for a data set",
+	}, []string{"protocol", "event"})
+)
+
+func init() {
+	prometheus.MustRegister(packetCount)
+	prometheus.MustRegister(templateCount)
+	prometheus.MustRegister(templateEvents)
+}
+
+// Flow is a decoded flow record.
+type Flow struct {
+	*netflow.Flow
+	// ExporterProtocol is the protocol the flow was exported in, such as
+	// "netflow_v5" or "ipfix".
+	ExporterProtocol string
+	// Enterprise holds the values of enterprise-specific information
+	// elements, keyed by "<enterprise number>/<element id>", in hex.
+	Enterprise map[string]string
+	// TCPFlags, Direction, Start and End are not set for NetFlow v9
+	// flows, which are decoded by tflow2.
+	//
+	// TCPFlags is the union of the TCP flags seen in the flow.
+	TCPFlags uint8
+	// Direction is "ingress" or "egress" if the exporter said which
+	// direction it observed the flow in.
+	Direction string
+	// Start and End are when the first and last packets of the flow were
+	// seen, if the exporter said.
+	Start, End time.Time
+}
+
+// A Decoder decodes export packets into flows.
+type Decoder interface {
+	// Protocol returns the name of the protocol decoded.
+	Protocol() string
+	// Decode decodes a packet sent by exporter.
+	Decode(exporter net.IP, pkt []byte) ([]*Flow, error)
+}
+
+// Serve decodes the export packets received on conn with d and sends the
+// flows in them to out, until reading from conn fails.
+func Serve(conn net.PacketConn, d Decoder, out chan<- *Flow) error {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		var exporter net.IP
+		if ua, ok := addr.(*net.UDPAddr); ok {
+			exporter = ua.IP
+		}
+		flows, err := d.Decode(exporter, buf[:n])
+		if err != nil {
+			packetCount.WithLabelValues(d.Protocol(), "error").Inc()
+			logrus.Debugf("%s from %s: %v", d.Protocol(), addr, err)
+		} else {
+			packetCount.WithLabelValues(d.Protocol(), "OK").Inc()
+		}
+		for _, f := range flows {
+			out <- f
+		}
+	}
+}
+
+// Listen listens for export packets on the UDP address addr and serves them
+// with d.
+func Listen(addr string, d Decoder, out chan<- *Flow) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return Serve(conn, d, out)
+}
+
+// router returns the address of an exporter in the form tflow2 uses.
+func router(exporter net.IP) []byte {
+	if ip4 := exporter.To4(); ip4 != nil {
+		return append([]byte(nil), ip4...)
+	}
+	return append([]byte(nil), exporter...)
+}
+
+// prefix returns the prefix of length bits containing ip.
+func prefix(ip []byte, bits int) *netflow.Pfx {
+	return &netflow.Pfx{
+		IP:   net.IP(ip).Mask(net.CIDRMask(bits, len(ip)*8)),
+		Mask: net.CIDRMask(bits, len(ip)*8),
+	}
+}
@@ -0,0 +1,463 @@
+package collector
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/bio-routing/tflow2/netflow"
+)
+
+const (
+	ipfixHeaderLen = 16
+	setHeaderLen   = 4
+	// set IDs below 256 are reserved
+	templateSetID        = 2
+	optionsTemplateSetID = 3
+	minDataSetID         = 256
+	// variableLength is the field length of variable-length elements
+	variableLength = 0xffff
+	enterpriseBit  = 0x8000
+)
+
+// Information element identifiers from the IANA IPFIX registry.
+const (
+	ieOctetDeltaCount            = 1
+	iePacketDeltaCount           = 2
+	ieProtocolIdentifier         = 4
+	ieTCPControlBits             = 6
+	ieSourceTransportPort        = 7
+	ieSourceIPv4Address          = 8
+	ieSourceIPv4PrefixLength     = 9
+	ieIngressInterface           = 10
+	ieDestinationTransportPort   = 11
+	ieDestinationIPv4Address     = 12
+	ieDestinationIPv4PrefixLen   = 13
+	ieEgressInterface            = 14
+	ieIPNextHopIPv4Address       = 15
+	ieBGPSourceASNumber          = 16
+	ieBGPDestinationASNumber     = 17
+	ieBGPNextHopIPv4Address      = 18
+	ieFlowEndSysUpTime           = 21
+	ieFlowStartSysUpTime         = 22
+	iePostOctetDeltaCount        = 23
+	iePostPacketDeltaCount       = 24
+	ieSourceIPv6Address          = 27
+	ieDestinationIPv6Address     = 28
+	ieSourceIPv6PrefixLength     = 29
+	ieDestinationIPv6PrefixLen   = 30
+	ieSamplingInterval           = 34
+	ieSamplerRandomInterval      = 50
+	ieFlowDirection              = 61
+	ieIPNextHopIPv6Address       = 62
+	ieBGPNextHopIPv6Address      = 63
+	ieOctetTotalCount            = 85
+	iePacketTotalCount           = 86
+	ieBGPNextAdjacentASNumber    = 128
+	ieFlowStartSeconds           = 150
+	ieFlowEndSeconds             = 151
+	ieFlowStartMilliseconds      = 152
+	ieFlowEndMilliseconds        = 153
+	ieSystemInitTimeMilliseconds = 160
+	ieSamplingPacketInterval     = 305
+	ieSamplingPacketSpace        = 306
+)
+
+// field is a field specifier in a template.
+type field struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+}
+
+type template struct {
+	fields []field
+	// options is set for options templates, whose records describe the
+	// exporter rather than flows.
+	options bool
+	updated time.Time
+}
+
+type templateKey struct {
+	exporter string
+	domain   uint32
+	id       uint16
+}
+
+type domainKey struct {
+	exporter string
+	domain   uint32
+}
+
+// IPFIX decodes IPFIX (version 10) messages. Templates are cached per
+// exporter and observation domain. It is not safe for concurrent use.
+type IPFIX struct {
+	// TemplateTimeout is how long a template is kept without being
+	// refreshed.
+	TemplateTimeout time.Duration
+
+	templates map[templateKey]*template
+	// rates holds sampling rates announced in options records.
+	rates     map[domainKey]uint64
+	lastSweep time.Time
+}
+
+// NewIPFIX returns a decoder that forgets templates after timeout.
+func NewIPFIX(timeout time.Duration) *IPFIX {
+	return &IPFIX{
+		TemplateTimeout: timeout,
+		templates:       make(map[templateKey]*template),
+		rates:           make(map[domainKey]uint64),
+	}
+}
+
+// Protocol implements Decoder.
+func (*IPFIX) Protocol() string { return "ipfix" }
+
+// Decode implements Decoder.
+func (d *IPFIX) Decode(exporter net.IP, pkt []byte) ([]*Flow, error) {
+	if len(pkt) < ipfixHeaderLen {
+		return nil, fmt.Errorf("short message: %d bytes", len(pkt))
+	}
+	if v := binary.BigEndian.Uint16(pkt); v != 10 {
+		return nil, fmt.Errorf("version %d; want 10", v)
+	}
+	length := int(binary.BigEndian.Uint16(pkt[2:]))
+	if length < ipfixHeaderLen || length > len(pkt) {
+		return nil, fmt.Errorf("message length %d; have %d bytes", length, len(pkt))
+	}
+	export := time.Unix(int64(binary.BigEndian.Uint32(pkt[4:])), 0)
+	domain := domainKey{exporter.String(), binary.BigEndian.Uint32(pkt[12:])}
+	d.sweep(time.Now())
+
+	var flows []*Flow
+	for b := pkt[ipfixHeaderLen:length]; len(b) > 0; {
+		if len(b) < setHeaderLen {
+			return flows, fmt.Errorf("truncated set header")
+		}
+		id, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if n < setHeaderLen || n > len(b) {
+			return flows, fmt.Errorf("set %d length %d; have %d bytes", id, n, len(b))
+		}
+		body := b[setHeaderLen:n]
+		b = b[n:]
+		var err error
+		switch {
+		case id == templateSetID:
+			err = d.templateSet(domain, body, false)
+		case id == optionsTemplateSetID:
+			err = d.templateSet(domain, body, true)
+		case id >= minDataSetID:
+			var fs []*Flow
+			fs, err = d.dataSet(exporter, domain, id, body, export)
+			flows = append(flows, fs...)
+		}
+		if err != nil {
+			return flows, fmt.Errorf("set %d: %v", id, err)
+		}
+	}
+	return flows, nil
+}
+
+// templateSet caches the templates in a template or options template set.
+func (d *IPFIX) templateSet(domain domainKey, b []byte, options bool) error {
+	for len(b) >= 4 {
+		id, count := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		k := templateKey{domain.exporter, domain.domain, id}
+		if count == 0 {
+			// a withdrawal, which has no scope field count even for
+			// options templates; withdrawing ID 2 or 3 withdraws all
+			// templates
+			d.withdraw(k)
+			continue
+		}
+		if options {
+			// the scope field count, which isn't needed to skip scopes
+			if len(b) < 2 {
+				return fmt.Errorf("template %d truncated", id)
+			}
+			b = b[2:]
+		}
+		t := &template{options: options, updated: time.Now()}
+		for i := 0; i < count; i++ {
+			if len(b) < 4 {
+				return fmt.Errorf("template %d truncated", id)
+			}
+			f := field{id: binary.BigEndian.Uint16(b), length: binary.BigEndian.Uint16(b[2:])}
+			b = b[4:]
+			if f.id&enterpriseBit != 0 {
+				if len(b) < 4 {
+					return fmt.Errorf("template %d truncated", id)
+				}
+				f.id &^= enterpriseBit
+				f.enterprise = binary.BigEndian.Uint32(b)
+				b = b[4:]
+			}
+			t.fields = append(t.fields, f)
+		}
+		if id < minDataSetID {
+			return fmt.Errorf("invalid template id %d", id)
+		}
+		event := "added"
+		if _, ok := d.templates[k]; ok {
+			event = "updated"
+		}
+		d.templates[k] = t
+		templateEvents.WithLabelValues(d.Protocol(), event).Inc()
+	}
+	templateCount.WithLabelValues(d.Protocol()).Set(float64(len(d.templates)))
+	return nil
+}
+
+func (d *IPFIX) withdraw(k templateKey) {
+	for tk := range d.templates {
+		if tk.exporter == k.exporter && tk.domain == k.domain && (tk.id == k.id || k.id == templateSetID || k.id == optionsTemplateSetID) {
+			delete(d.templates, tk)
+			templateEvents.WithLabelValues(d.Protocol(), "withdrawn").Inc()
+		}
+	}
+	templateCount.WithLabelValues(d.Protocol()).Set(float64(len(d.templates)))
+}
+
+// sweep forgets templates that haven't been refreshed, at most once a
+// minute.
+func (d *IPFIX) sweep(now time.Time) {
+	if d.TemplateTimeout <= 0 || now.Sub(d.lastSweep) < time.Minute {
+		return
+	}
+	d.lastSweep = now
+	for k, t := range d.templates {
+		if now.Sub(t.updated) > d.TemplateTimeout {
+			delete(d.templates, k)
+			templateEvents.WithLabelValues(d.Protocol(), "expired").Inc()
+		}
+	}
+	templateCount.WithLabelValues(d.Protocol()).Set(float64(len(d.templates)))
+}
+
+// dataSet decodes the records in a data set.
+func (d *IPFIX) dataSet(exporter net.IP, domain domainKey, id uint16, b []byte, export time.Time) ([]*Flow, error) {
+	t, ok := d.templates[templateKey{domain.exporter, domain.domain, id}]
+	if !ok {
+		templateEvents.WithLabelValues(d.Protocol(), "missing").Inc()
+		return nil, nil
+	}
+	var flows []*Flow
+	for len(b) > 0 {
+		values, n, err := t.values(b)
+		if err != nil {
+			if isPadding(b) {
+				break
+			}
+			return flows, err
+		}
+		b = b[n:]
+		if t.options {
+			if rate := samplingRate(values); rate > 0 {
+				d.rates[domain] = rate
+			}
+			continue
+		}
+		f := d.flow(exporter, values, export)
+		if f.Samplerate == 0 {
+			f.Samplerate = d.rates[domain]
+		}
+		flows = append(flows, f)
+	}
+	return flows, nil
+}
+
+// isPadding reports whether the rest of a set is padding.
+func isPadding(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type value struct {
+	field
+	data []byte
+}
+
+// values splits a data record into its fields, returning them and the
+// length of the record.
+func (t *template) values(b []byte) ([]value, int, error) {
+	values := make([]value, 0, len(t.fields))
+	off := 0
+	for _, f := range t.fields {
+		n := int(f.length)
+		if f.length == variableLength {
+			if off >= len(b) {
+				return nil, 0, fmt.Errorf("record truncated")
+			}
+			n = int(b[off])
+			off++
+			if n == 255 {
+				if off+2 > len(b) {
+					return nil, 0, fmt.Errorf("record truncated")
+				}
+				n = int(binary.BigEndian.Uint16(b[off:]))
+				off += 2
+			}
+		}
+		if off+n > len(b) {
+			return nil, 0, fmt.Errorf("record truncated")
+		}
+		values = append(values, value{f, b[off : off+n]})
+		off += n
+	}
+	if off == 0 {
+		return nil, 0, fmt.Errorf("empty record")
+	}
+	return values, off, nil
+}
+
+// uintValue decodes an unsigned integer, which may use reduced-size encoding.
+func uintValue(b []byte) uint64 {
+	if len(b) > 8 {
+		b = b[len(b)-8:]
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// samplingRate returns the sampling rate in a data record, or 0 if it
+// doesn't have one.
+func samplingRate(values []value) uint64 {
+	var interval, space uint64
+	for _, v := range values {
+		if v.enterprise != 0 {
+			continue
+		}
+		switch v.id {
+		case ieSamplingInterval, ieSamplerRandomInterval:
+			return uintValue(v.data)
+		case ieSamplingPacketInterval:
+			interval = uintValue(v.data)
+		case ieSamplingPacketSpace:
+			space = uintValue(v.data)
+		}
+	}
+	if interval == 0 {
+		return 0
+	}
+	// interval packets are sampled, then space packets skipped
+	return (interval + space) / interval
+}
+
+// flow converts a data record to a flow.
+func (d *IPFIX) flow(exporter net.IP, values []value, export time.Time) *Flow {
+	f := &netflow.Flow{
+		Router:    router(exporter),
+		Timestamp: export.Unix(),
+	}
+	out := &Flow{Flow: f, ExporterProtocol: d.Protocol()}
+	srcLen, dstLen := -1, -1
+	var sysInit, startUptime, endUptime uint64
+	for _, v := range values {
+		if v.enterprise != 0 {
+			if out.Enterprise == nil {
+				out.Enterprise = make(map[string]string)
+			}
+			out.Enterprise[strconv.FormatUint(uint64(v.enterprise), 10)+"/"+strconv.Itoa(int(v.id))] = hex.EncodeToString(v.data)
+			continue
+		}
+		u := uintValue(v.data)
+		switch v.id {
+		case ieOctetDeltaCount, ieOctetTotalCount, iePostOctetDeltaCount:
+			if f.Size == 0 {
+				f.Size = u
+			}
+		case iePacketDeltaCount, iePacketTotalCount, iePostPacketDeltaCount:
+			if f.Packets == 0 {
+				f.Packets = u
+			}
+		case ieProtocolIdentifier:
+			f.Protocol = uint32(u)
+		case ieSourceTransportPort:
+			f.SrcPort = uint32(u)
+		case ieDestinationTransportPort:
+			f.DstPort = uint32(u)
+		case ieSourceIPv4Address, ieSourceIPv6Address:
+			f.SrcAddr = append([]byte(nil), v.data...)
+		case ieDestinationIPv4Address, ieDestinationIPv6Address:
+			f.DstAddr = append([]byte(nil), v.data...)
+		case ieSourceIPv4PrefixLength, ieSourceIPv6PrefixLength:
+			srcLen = int(u)
+		case ieDestinationIPv4PrefixLen, ieDestinationIPv6PrefixLen:
+			dstLen = int(u)
+		case ieIngressInterface:
+			f.IntIn = uint32(u)
+		case ieEgressInterface:
+			f.IntOut = uint32(u)
+		case ieIPNextHopIPv4Address, ieIPNextHopIPv6Address, ieBGPNextHopIPv4Address, ieBGPNextHopIPv6Address:
+			if f.NextHop == nil {
+				f.NextHop = append([]byte(nil), v.data...)
+			}
+		case ieBGPSourceASNumber:
+			f.SrcAs = uint32(u)
+		case ieBGPDestinationASNumber:
+			f.DstAs = uint32(u)
+		case ieBGPNextAdjacentASNumber:
+			f.NextHopAs = uint32(u)
+		case ieTCPControlBits:
+			out.TCPFlags = uint8(u)
+		case ieFlowDirection:
+			switch u {
+			case 0:
+				out.Direction = "ingress"
+			case 1:
+				out.Direction = "egress"
+			}
+		case ieFlowStartSeconds:
+			out.Start = time.Unix(int64(u), 0)
+		case ieFlowStartMilliseconds:
+			out.Start = time.Unix(0, int64(u)*int64(time.Millisecond))
+		case ieFlowEndSeconds:
+			out.End = time.Unix(int64(u), 0)
+		case ieFlowEndMilliseconds:
+			out.End = time.Unix(0, int64(u)*int64(time.Millisecond))
+		case ieFlowStartSysUpTime:
+			startUptime = u
+		case ieFlowEndSysUpTime:
+			endUptime = u
+		case ieSystemInitTimeMilliseconds:
+			sysInit = u
+		}
+	}
+	if sysInit > 0 {
+		if startUptime > 0 {
+			out.Start = time.Unix(0, int64(sysInit+startUptime)*int64(time.Millisecond))
+		}
+		if endUptime > 0 {
+			out.End = time.Unix(0, int64(sysInit+endUptime)*int64(time.Millisecond))
+		}
+	}
+	if !out.End.IsZero() {
+		f.Timestamp = out.End.Unix()
+	}
+	switch len(f.SrcAddr) {
+	case net.IPv4len:
+		f.Family = 4
+	case net.IPv6len:
+		f.Family = 6
+	}
+	if srcLen >= 0 && len(f.SrcAddr) > 0 {
+		f.SrcPfx = prefix(f.SrcAddr, srcLen)
+	}
+	if dstLen >= 0 && len(f.DstAddr) > 0 {
+		f.DstPfx = prefix(f.DstAddr, dstLen)
+	}
+	f.Samplerate = samplingRate(values)
+	return out
+}
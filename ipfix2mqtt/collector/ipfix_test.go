@@ -0,0 +1,199 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// message builds an IPFIX message.
+type message struct {
+	bytes.Buffer
+}
+
+func (m *message) u8(v uint8)   { m.WriteByte(v) }
+func (m *message) u16(v uint16) { binary.Write(m, binary.BigEndian, v) }
+func (m *message) u32(v uint32) { binary.Write(m, binary.BigEndian, v) }
+
+// set appends a set with the given ID and body.
+func (m *message) set(id uint16, body []byte) {
+	m.u16(id)
+	m.u16(uint16(len(body) + setHeaderLen))
+	m.Write(body)
+}
+
+// packet returns the message with its header.
+func (m *message) packet(export uint32) []byte {
+	var h message
+	h.u16(10)
+	h.u16(uint16(m.Len() + ipfixHeaderLen))
+	h.u32(export)
+	h.u32(1)
+	h.u32(7)
+	return append(h.Bytes(), m.Bytes()...)
+}
+
+var exporter = net.ParseIP("192.168.8.1")
+
+func templates() []byte {
+	var t message
+	t.u16(256)
+	t.u16(7)
+	for _, f := range [][2]uint16{
+		{ieSourceIPv4Address, 4},
+		{ieDestinationIPv4Address, 4},
+		{ieSourceIPv4PrefixLength, 1},
+		{ieProtocolIdentifier, 1},
+		{ieDestinationTransportPort, 2},
+		{ieOctetDeltaCount, 4}, // reduced-size encoding
+	} {
+		t.u16(f[0])
+		t.u16(f[1])
+	}
+	// a variable-length enterprise-specific element
+	t.u16(12 | enterpriseBit)
+	t.u16(variableLength)
+	t.u32(9)
+	return t.Bytes()
+}
+
+func records() []byte {
+	var d message
+	d.Write([]byte{192, 168, 8, 68, 104, 21, 1, 1, 24, 6})
+	d.u16(443)
+	d.u32(1500)
+	d.u8(3)
+	d.WriteString("abc")
+	d.Write([]byte{192, 168, 8, 69, 8, 8, 8, 8, 24, 17})
+	d.u16(53)
+	d.u32(80)
+	d.u8(255)
+	d.u16(1)
+	d.WriteString("x")
+	d.Write([]byte{0, 0, 0}) // padding
+	return d.Bytes()
+}
+
+func TestIPFIX(t *testing.T) {
+	d := NewIPFIX(time.Hour)
+
+	// data before its template is dropped
+	var early message
+	early.set(256, records())
+	flows, err := d.Decode(exporter, early.packet(1581969154))
+	if err != nil || len(flows) != 0 {
+		t.Fatalf("Decode() before template = %d flows, %v; want none", len(flows), err)
+	}
+
+	var m message
+	m.set(templateSetID, templates())
+	m.set(256, records())
+	flows, err = d.Decode(exporter, m.packet(1581969154))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("got %d flows; want 2", len(flows))
+	}
+	f := flows[0]
+	if !net.IP(f.SrcAddr).Equal(net.ParseIP("192.168.8.68")) || !net.IP(f.DstAddr).Equal(net.ParseIP("104.21.1.1")) {
+		t.Errorf("addresses = %v -> %v", net.IP(f.SrcAddr), net.IP(f.DstAddr))
+	}
+	if f.Family != 4 || f.Protocol != 6 || f.DstPort != 443 || f.Size != 1500 {
+		t.Errorf("flow = family %d protocol %d port %d size %d; want 4, 6, 443, 1500", f.Family, f.Protocol, f.DstPort, f.Size)
+	}
+	if want, got := "192.168.8.0", net.IP(f.SrcPfx.IP).String(); want != got {
+		t.Errorf("source prefix = %s; want %s", got, want)
+	}
+	if want, got := "616263", f.Enterprise["9/12"]; want != got {
+		t.Errorf("enterprise 9/12 = %q; want %q", got, want)
+	}
+	if want, got := "78", flows[1].Enterprise["9/12"]; want != got {
+		t.Errorf("second enterprise 9/12 = %q; want %q", got, want)
+	}
+	if f.ExporterProtocol != "ipfix" || f.Timestamp != 1581969154 {
+		t.Errorf("protocol %q, timestamp %d", f.ExporterProtocol, f.Timestamp)
+	}
+
+	// templates are per exporter
+	if flows, _ := d.Decode(net.ParseIP("192.168.8.2"), early.packet(1581969155)); len(flows) != 0 {
+		t.Errorf("got %d flows from another exporter; want 0", len(flows))
+	}
+
+	// withdrawing all templates
+	var w message
+	w.set(templateSetID, []byte{0, templateSetID, 0, 0})
+	if _, err := d.Decode(exporter, w.packet(1581969156)); err != nil {
+		t.Fatal(err)
+	}
+	if flows, _ := d.Decode(exporter, early.packet(1581969157)); len(flows) != 0 {
+		t.Errorf("got %d flows after withdrawal; want 0", len(flows))
+	}
+}
+
+func TestIPFIX_OptionsSamplingRate(t *testing.T) {
+	d := NewIPFIX(time.Hour)
+	var opts message
+	opts.u16(257)
+	opts.u16(1)
+	opts.u16(0)
+	opts.u16(ieSamplingInterval)
+	opts.u16(4)
+	var m message
+	m.set(optionsTemplateSetID, opts.Bytes())
+	m.set(257, []byte{0, 0, 0x02, 0})
+	m.set(templateSetID, templates())
+	m.set(256, records())
+	flows, err := d.Decode(exporter, m.packet(1581969154))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 || flows[0].Samplerate != 512 {
+		t.Errorf("got %d flows, rate %d; want 2 at 512", len(flows), flows[0].Samplerate)
+	}
+
+	// a withdrawal has no scope field count, so the options template after
+	// it in the same set still parses
+	var replace message
+	replace.u16(257)
+	replace.u16(0)
+	replace.u16(258)
+	replace.u16(1)
+	replace.u16(0)
+	replace.u16(ieSamplingInterval)
+	replace.u16(4)
+	m.Reset()
+	m.set(optionsTemplateSetID, replace.Bytes())
+	m.set(258, []byte{0, 0, 0x04, 0})
+	m.set(256, records())
+	flows, err = d.Decode(exporter, m.packet(1581969155))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 || flows[0].Samplerate != 1024 {
+		t.Errorf("got %d flows, rate %d after replacing options template; want 2 at 1024", len(flows), flows[0].Samplerate)
+	}
+	for k := range d.templates {
+		if k.id == 257 {
+			t.Error("options template 257 not withdrawn")
+		}
+	}
+}
+
+func TestIPFIX_Errors(t *testing.T) {
+	d := NewIPFIX(time.Hour)
+	var m message
+	m.set(templateSetID, templates())
+	good := m.packet(1)
+	for name, pkt := range map[string][]byte{
+		"short":     good[:10],
+		"version":   append([]byte{0, 9}, good[2:]...),
+		"truncated": good[:len(good)-3],
+	} {
+		if _, err := d.Decode(exporter, pkt); err == nil {
+			t.Errorf("Decode(%s) succeeded; want error", name)
+		}
+	}
+}
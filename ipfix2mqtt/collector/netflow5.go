@@ -0,0 +1,76 @@
+package collector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bio-routing/tflow2/netflow"
+)
+
+const (
+	nf5HeaderLen = 24
+	nf5RecordLen = 48
+)
+
+// NetflowV5 decodes NetFlow v5 packets.
+type NetflowV5 struct{}
+
+// Protocol implements Decoder.
+func (NetflowV5) Protocol() string { return "netflow_v5" }
+
+// Decode implements Decoder.
+func (d NetflowV5) Decode(exporter net.IP, pkt []byte) ([]*Flow, error) {
+	if len(pkt) < nf5HeaderLen {
+		return nil, fmt.Errorf("short packet: %d bytes", len(pkt))
+	}
+	if v := binary.BigEndian.Uint16(pkt); v != 5 {
+		return nil, fmt.Errorf("version %d; want 5", v)
+	}
+	count := int(binary.BigEndian.Uint16(pkt[2:]))
+	if want := nf5HeaderLen + count*nf5RecordLen; len(pkt) < want {
+		return nil, fmt.Errorf("%d records need %d bytes; have %d", count, want, len(pkt))
+	}
+	uptime := binary.BigEndian.Uint32(pkt[4:])
+	export := time.Unix(int64(binary.BigEndian.Uint32(pkt[8:])), int64(binary.BigEndian.Uint32(pkt[12:])))
+	// the top two bits are the sampling mode
+	rate := uint64(binary.BigEndian.Uint16(pkt[22:]) & 0x3fff)
+
+	flows := make([]*Flow, 0, count)
+	for i := 0; i < count; i++ {
+		r := pkt[nf5HeaderLen+i*nf5RecordLen:]
+		first, last := binary.BigEndian.Uint32(r[24:]), binary.BigEndian.Uint32(r[28:])
+		start := export.Add(-time.Duration(uptime-first) * time.Millisecond)
+		end := export.Add(-time.Duration(uptime-last) * time.Millisecond)
+		src, dst := append([]byte(nil), r[0:4]...), append([]byte(nil), r[4:8]...)
+		f := &netflow.Flow{
+			Router:     router(exporter),
+			Family:     4,
+			SrcAddr:    src,
+			DstAddr:    dst,
+			NextHop:    append([]byte(nil), r[8:12]...),
+			IntIn:      uint32(binary.BigEndian.Uint16(r[12:])),
+			IntOut:     uint32(binary.BigEndian.Uint16(r[14:])),
+			Packets:    uint64(binary.BigEndian.Uint32(r[16:])),
+			Size:       uint64(binary.BigEndian.Uint32(r[20:])),
+			SrcPort:    uint32(binary.BigEndian.Uint16(r[32:])),
+			DstPort:    uint32(binary.BigEndian.Uint16(r[34:])),
+			Protocol:   uint32(r[38]),
+			SrcAs:      uint32(binary.BigEndian.Uint16(r[40:])),
+			DstAs:      uint32(binary.BigEndian.Uint16(r[42:])),
+			SrcPfx:     prefix(src, int(r[44])),
+			DstPfx:     prefix(dst, int(r[45])),
+			Samplerate: rate,
+			Timestamp:  end.Unix(),
+		}
+		flows = append(flows, &Flow{
+			Flow:             f,
+			ExporterProtocol: d.Protocol(),
+			TCPFlags:         r[37],
+			Start:            start,
+			End:              end,
+		})
+	}
+	return flows, nil
+}
@@ -0,0 +1,67 @@
+package collector
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetflowV5(t *testing.T) {
+	var m message
+	m.u16(5)
+	m.u16(1)
+	m.u32(60000)      // uptime
+	m.u32(1581969154) // export time
+	m.u32(0)
+	m.u32(1)
+	m.u8(0)
+	m.u8(0)
+	m.u16(0x4000 | 100) // random sampling, 1 in 100
+	m.Write([]byte{192, 168, 8, 68, 104, 21, 1, 1, 192, 168, 8, 1})
+	m.u16(2)     // input
+	m.u16(1)     // output
+	m.u32(10)    // packets
+	m.u32(1500)  // octets
+	m.u32(50000) // first
+	m.u32(58000) // last
+	m.u16(50123)
+	m.u16(443)
+	m.Write([]byte{0, 0x18, 6, 0})
+	m.u16(0)
+	m.u16(13335)
+	m.Write([]byte{24, 12, 0, 0})
+
+	flows, err := NetflowV5{}.Decode(exporter, m.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 1 {
+		t.Fatalf("got %d flows; want 1", len(flows))
+	}
+	f := flows[0]
+	if !net.IP(f.SrcAddr).Equal(net.ParseIP("192.168.8.68")) || f.DstPort != 443 || f.Protocol != 6 {
+		t.Errorf("flow = %v:%d proto %d", net.IP(f.SrcAddr), f.DstPort, f.Protocol)
+	}
+	if f.IntIn != 2 || f.IntOut != 1 || f.Packets != 10 || f.Size != 1500 || f.DstAs != 13335 {
+		t.Errorf("flow = in %d out %d packets %d size %d dst as %d", f.IntIn, f.IntOut, f.Packets, f.Size, f.DstAs)
+	}
+	if f.TCPFlags != 0x18 || f.End.Sub(f.Start) != 8*time.Second {
+		t.Errorf("TCPFlags = %#x, duration %s; want 0x18, 8s", f.TCPFlags, f.End.Sub(f.Start))
+	}
+	if f.Samplerate != 100 {
+		t.Errorf("Samplerate = %d; want 100", f.Samplerate)
+	}
+	if want := int64(1581969154 - 2); f.Timestamp != want {
+		t.Errorf("Timestamp = %d; want %d", f.Timestamp, want)
+	}
+	if want, got := "104.16.0.0", net.IP(f.DstPfx.IP).String(); want != got {
+		t.Errorf("DstPfx = %s; want %s", got, want)
+	}
+	if !net.IP(f.Router).Equal(exporter) || f.ExporterProtocol != "netflow_v5" {
+		t.Errorf("router %v, protocol %q", net.IP(f.Router), f.ExporterProtocol)
+	}
+
+	if _, err := (NetflowV5{}).Decode(exporter, m.Bytes()[:50]); err == nil {
+		t.Error("Decode(truncated) succeeded; want error")
+	}
+}
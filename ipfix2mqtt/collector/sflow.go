@@ -0,0 +1,350 @@
+package collector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bio-routing/tflow2/netflow"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// sFlow v5 sample and record formats, from sflow_version_5.txt.
+const (
+	sflowFlowSample            = 1
+	sflowCounterSample         = 2
+	sflowExpandedFlowSample    = 3
+	sflowExpandedCounterSample = 4
+
+	sflowRawHeader      = 1
+	sflowIPv4Data       = 3
+	sflowIPv6Data       = 4
+	sflowExtendedRouter = 1002
+	sflowExtendedGW     = 1003
+
+	sflowGenericInterface = 1
+
+	sflowHeaderEthernet = 1
+	sflowHeaderIPv4     = 11
+	sflowHeaderIPv6     = 12
+)
+
+// Counters is an interface counter sample.
+type Counters struct {
+	// Router is published as a string by the caller.
+	Router          []byte    `json:"-"`
+	Timestamp       time.Time `json:"timestamp"`
+	IfIndex         uint32    `json:"if_index"`
+	IfType          uint32    `json:"if_type"`
+	IfSpeed         uint64    `json:"if_speed"`
+	IfDirection     uint32    `json:"if_direction"`
+	AdminUp         bool      `json:"admin_up"`
+	OperUp          bool      `json:"oper_up"`
+	InOctets        uint64    `json:"in_octets"`
+	InUcastPkts     uint32    `json:"in_ucast_pkts"`
+	InMulticastPkts uint32    `json:"in_multicast_pkts"`
+	InBroadcastPkts uint32    `json:"in_broadcast_pkts"`
+	InDiscards      uint32    `json:"in_discards"`
+	InErrors        uint32    `json:"in_errors"`
+	InUnknownProtos uint32    `json:"in_unknown_protos"`
+	OutOctets       uint64    `json:"out_octets"`
+	OutUcastPkts    uint32    `json:"out_ucast_pkts"`
+	OutMulticastPkt uint32    `json:"out_multicast_pkts"`
+	OutBroadcastPkt uint32    `json:"out_broadcast_pkts"`
+	OutDiscards     uint32    `json:"out_discards"`
+	OutErrors       uint32    `json:"out_errors"`
+	Promiscuous     bool      `json:"promiscuous"`
+}
+
+// SFlow decodes sFlow v5 datagrams. Flow samples are returned as flows with
+// one packet each, and counter samples sent to a channel.
+type SFlow struct {
+	counters chan<- *Counters
+}
+
+// NewSFlow returns a decoder that sends interface counter samples to
+// counters, unless it is nil.
+func NewSFlow(counters chan<- *Counters) *SFlow {
+	return &SFlow{counters: counters}
+}
+
+// Protocol implements Decoder.
+func (*SFlow) Protocol() string { return "sflow_v5" }
+
+// Decode implements Decoder. Flows are attributed to the agent address in
+// the datagram, not the address it was sent from.
+func (d *SFlow) Decode(exporter net.IP, pkt []byte) ([]*Flow, error) {
+	r := &xdr{b: pkt}
+	if v := r.u32(); v != 5 {
+		return nil, fmt.Errorf("version %d; want 5", v)
+	}
+	agent := r.addr()
+	r.skip(12) // sub-agent ID, sequence number, uptime
+	n := r.u32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	now := time.Now()
+	var flows []*Flow
+	for i := uint32(0); i < n; i++ {
+		format, body := r.u32(), r.opaque()
+		if r.err != nil {
+			return flows, r.err
+		}
+		s := &xdr{b: body}
+		switch format {
+		case sflowFlowSample, sflowExpandedFlowSample:
+			if f := d.flowSample(agent, s, format == sflowExpandedFlowSample, now); f != nil {
+				flows = append(flows, f)
+			}
+		case sflowCounterSample, sflowExpandedCounterSample:
+			d.counterSample(agent, s, format == sflowExpandedCounterSample, now)
+		}
+		if s.err != nil {
+			return flows, fmt.Errorf("sample %d: %v", i, s.err)
+		}
+	}
+	return flows, nil
+}
+
+func (d *SFlow) flowSample(agent net.IP, r *xdr, expanded bool, now time.Time) *Flow {
+	f := &netflow.Flow{Router: router(agent), Timestamp: now.Unix(), Packets: 1}
+	r.skip(4) // sequence number
+	if expanded {
+		r.skip(8) // source ID type and index
+	} else {
+		r.skip(4)
+	}
+	f.Samplerate = uint64(r.u32())
+	r.skip(8) // sample pool, drops
+	if expanded {
+		if r.u32() == 0 {
+			f.IntIn = r.u32()
+		} else {
+			r.skip(4)
+		}
+		if r.u32() == 0 {
+			f.IntOut = r.u32()
+		} else {
+			r.skip(4)
+		}
+	} else {
+		f.IntIn = r.u32() & 0x3fffffff
+		// the top two bits say whether this is an interface index
+		if out := r.u32(); out>>30 == 0 {
+			f.IntOut = out
+		}
+	}
+	var flags uint8
+	n := r.u32()
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		format, body := r.u32(), r.opaque()
+		rec := &xdr{b: body}
+		switch format {
+		case sflowRawHeader:
+			flags = rawHeader(f, rec)
+		case sflowIPv4Data, sflowIPv6Data:
+			flags = ipData(f, rec, format == sflowIPv6Data)
+		case sflowExtendedRouter:
+			nh := rec.addr()
+			src, dst := rec.u32(), rec.u32()
+			if rec.err == nil {
+				f.NextHop = router(nh)
+				if len(f.SrcAddr) > 0 {
+					f.SrcPfx = prefix(f.SrcAddr, int(src))
+				}
+				if len(f.DstAddr) > 0 {
+					f.DstPfx = prefix(f.DstAddr, int(dst))
+				}
+			}
+		case sflowExtendedGW:
+			extendedGateway(f, rec)
+		}
+	}
+	if r.err != nil {
+		return nil
+	}
+	return &Flow{Flow: f, ExporterProtocol: d.Protocol(), TCPFlags: flags, Start: now, End: now}
+}
+
+// rawHeader fills in a flow from a sampled packet header, returning its TCP
+// flags.
+func rawHeader(f *netflow.Flow, r *xdr) uint8 {
+	proto := r.u32()
+	f.Size = uint64(r.u32())
+	r.skip(4) // bytes stripped
+	hdr := r.opaque()
+	if r.err != nil {
+		return 0
+	}
+	var first gopacket.Decoder
+	switch proto {
+	case sflowHeaderEthernet:
+		first = layers.LayerTypeEthernet
+	case sflowHeaderIPv4:
+		first = layers.LayerTypeIPv4
+	case sflowHeaderIPv6:
+		first = layers.LayerTypeIPv6
+	default:
+		return 0
+	}
+	p := gopacket.NewPacket(hdr, first, gopacket.DecodeOptions{Lazy: true})
+	switch n := p.NetworkLayer().(type) {
+	case *layers.IPv4:
+		f.Family = 4
+		f.SrcAddr, f.DstAddr = append([]byte(nil), n.SrcIP.To4()...), append([]byte(nil), n.DstIP.To4()...)
+		f.Protocol = uint32(n.Protocol)
+	case *layers.IPv6:
+		f.Family = 6
+		f.SrcAddr, f.DstAddr = append([]byte(nil), n.SrcIP...), append([]byte(nil), n.DstIP...)
+		f.Protocol = uint32(n.NextHeader)
+	}
+	switch t := p.TransportLayer().(type) {
+	case *layers.TCP:
+		f.SrcPort, f.DstPort = uint32(t.SrcPort), uint32(t.DstPort)
+		return tcpFlags(t)
+	case *layers.UDP:
+		f.SrcPort, f.DstPort = uint32(t.SrcPort), uint32(t.DstPort)
+	}
+	return 0
+}
+
+// tcpFlags returns the flags of a TCP header as in the flags byte.
+func tcpFlags(t *layers.TCP) uint8 {
+	var flags uint8
+	for i, set := range []bool{t.FIN, t.SYN, t.RST, t.PSH, t.ACK, t.URG, t.ECE, t.CWR} {
+		if set {
+			flags |= 1 << uint(i)
+		}
+	}
+	return flags
+}
+
+// ipData fills in a flow from an IPv4 or IPv6 data record, returning its TCP
+// flags.
+func ipData(f *netflow.Flow, r *xdr, v6 bool) uint8 {
+	size, proto := r.u32(), r.u32()
+	n, family := 4, uint32(4)
+	if v6 {
+		n, family = 16, 6
+	}
+	src, dst := r.fixed(n), r.fixed(n)
+	sport, dport, flags := r.u32(), r.u32(), r.u32()
+	if r.err != nil {
+		return 0
+	}
+	f.Family, f.Protocol, f.Size = family, proto, uint64(size)
+	f.SrcAddr, f.DstAddr = append([]byte(nil), src...), append([]byte(nil), dst...)
+	f.SrcPort, f.DstPort = sport, dport
+	return uint8(flags)
+}
+
+// extendedGateway fills in a flow's AS numbers from BGP data.
+func extendedGateway(f *netflow.Flow, r *xdr) {
+	r.addr()  // next hop
+	r.skip(4) // router's own AS
+	src := r.u32()
+	r.skip(4) // source peer AS
+	var dst uint32
+	for segs := r.u32(); segs > 0 && r.err == nil; segs-- {
+		r.skip(4) // segment type
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			dst = r.u32()
+		}
+	}
+	if r.err == nil {
+		f.SrcAs, f.DstAs = src, dst
+	}
+}
+
+func (d *SFlow) counterSample(agent net.IP, r *xdr, expanded bool, now time.Time) {
+	r.skip(4) // sequence number
+	if expanded {
+		r.skip(8)
+	} else {
+		r.skip(4)
+	}
+	n := r.u32()
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		format, body := r.u32(), r.opaque()
+		if format != sflowGenericInterface || d.counters == nil {
+			continue
+		}
+		c := &xdr{b: body}
+		out := &Counters{Router: router(agent), Timestamp: now}
+		out.IfIndex, out.IfType, out.IfSpeed, out.IfDirection = c.u32(), c.u32(), c.u64(), c.u32()
+		status := c.u32()
+		out.AdminUp, out.OperUp = status&1 != 0, status&2 != 0
+		out.InOctets = c.u64()
+		out.InUcastPkts, out.InMulticastPkts, out.InBroadcastPkts = c.u32(), c.u32(), c.u32()
+		out.InDiscards, out.InErrors, out.InUnknownProtos = c.u32(), c.u32(), c.u32()
+		out.OutOctets = c.u64()
+		out.OutUcastPkts, out.OutMulticastPkt, out.OutBroadcastPkt = c.u32(), c.u32(), c.u32()
+		out.OutDiscards, out.OutErrors = c.u32(), c.u32()
+		out.Promiscuous = c.u32() == 1
+		if c.err == nil {
+			d.counters <- out
+		}
+	}
+}
+
+// xdr reads XDR-encoded values, recording the first error.
+type xdr struct {
+	b   []byte
+	err error
+}
+
+func (r *xdr) fixed(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = fmt.Errorf("truncated: want %d bytes, have %d", n, len(r.b))
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *xdr) skip(n int) { r.fixed(n) }
+
+func (r *xdr) u32() uint32 {
+	if b := r.fixed(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *xdr) u64() uint64 {
+	if b := r.fixed(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// opaque reads variable-length data, which is padded to a multiple of four
+// bytes.
+func (r *xdr) opaque() []byte {
+	n := int(r.u32())
+	v := r.fixed(n)
+	r.skip((4 - n%4) % 4)
+	return v
+}
+
+// addr reads an sFlow address: a type followed by an IPv4 or IPv6 address.
+func (r *xdr) addr() net.IP {
+	switch t := r.u32(); t {
+	case 1:
+		return net.IP(r.fixed(4))
+	case 2:
+		return net.IP(r.fixed(16))
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unknown address type %d", t)
+		}
+		return nil
+	}
+}
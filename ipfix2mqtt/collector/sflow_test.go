@@ -0,0 +1,139 @@
+package collector
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// opaque appends XDR variable-length data.
+func (m *message) opaque(b []byte) {
+	m.u32(uint32(len(b)))
+	m.Write(b)
+	m.Write(make([]byte, (4-len(b)%4)%4))
+}
+
+func (m *message) u64(v uint64) {
+	m.u32(uint32(v >> 32))
+	m.u32(uint32(v))
+}
+
+func packetHeader(t *testing.T) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("192.168.8.68"), DstIP: net.ParseIP("104.21.1.1")}
+	tcp := &layers.TCP{SrcPort: 50123, DstPort: 443, ACK: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, tcp, gopacket.Payload(make([]byte, 61))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSFlow(t *testing.T) {
+	var flow message
+	flow.u32(1)       // sequence
+	flow.u32(3)       // source ID
+	flow.u32(1024)    // sampling rate
+	flow.u32(1 << 20) // sample pool
+	flow.u32(0)       // drops
+	flow.u32(3)       // input
+	flow.u32(5)       // output
+	flow.u32(2)       // records
+	var raw message
+	raw.u32(sflowHeaderEthernet)
+	raw.u32(1514) // frame length
+	raw.u32(4)    // stripped
+	raw.opaque(packetHeader(t))
+	flow.u32(sflowRawHeader)
+	flow.opaque(raw.Bytes())
+	var gw message
+	gw.u32(1)
+	gw.Write(net.ParseIP("192.168.8.1").To4())
+	gw.u32(64512)
+	gw.u32(64512)
+	gw.u32(0)
+	gw.u32(1) // segments
+	gw.u32(2) // AS_SEQUENCE
+	gw.u32(2)
+	gw.u32(174)
+	gw.u32(13335)
+	gw.u32(0) // communities
+	gw.u32(100)
+	flow.u32(sflowExtendedGW)
+	flow.opaque(gw.Bytes())
+
+	var counters message
+	counters.u32(1) // sequence
+	counters.u32(3) // source ID
+	counters.u32(1) // records
+	var ifc message
+	ifc.u32(3)
+	ifc.u32(6)
+	ifc.u64(1000000000)
+	ifc.u32(1)
+	ifc.u32(3)
+	ifc.u64(123456789)
+	for i := 0; i < 6; i++ {
+		ifc.u32(uint32(i))
+	}
+	ifc.u64(987654321)
+	for i := 0; i < 5; i++ {
+		ifc.u32(uint32(i))
+	}
+	ifc.u32(2)
+	counters.u32(sflowGenericInterface)
+	counters.opaque(ifc.Bytes())
+
+	var m message
+	m.u32(5)
+	m.u32(1)
+	m.Write(net.ParseIP("192.168.8.2").To4())
+	m.u32(0)
+	m.u32(1)
+	m.u32(60000)
+	m.u32(2)
+	m.u32(sflowFlowSample)
+	m.opaque(flow.Bytes())
+	m.u32(sflowCounterSample)
+	m.opaque(counters.Bytes())
+
+	ch := make(chan *Counters, 1)
+	flows, err := NewSFlow(ch).Decode(exporter, m.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 1 {
+		t.Fatalf("got %d flows; want 1", len(flows))
+	}
+	f := flows[0]
+	if !net.IP(f.Router).Equal(net.ParseIP("192.168.8.2")) {
+		t.Errorf("Router = %v; want agent address 192.168.8.2", net.IP(f.Router))
+	}
+	if !net.IP(f.SrcAddr).Equal(net.ParseIP("192.168.8.68")) || f.DstPort != 443 || f.SrcPort != 50123 || f.Protocol != 6 || f.Family != 4 {
+		t.Errorf("flow = %v:%d -> %v:%d proto %d family %d", net.IP(f.SrcAddr), f.SrcPort, net.IP(f.DstAddr), f.DstPort, f.Protocol, f.Family)
+	}
+	if f.Samplerate != 1024 || f.Size != 1514 || f.Packets != 1 || f.IntIn != 3 || f.IntOut != 5 {
+		t.Errorf("flow = rate %d size %d packets %d in %d out %d", f.Samplerate, f.Size, f.Packets, f.IntIn, f.IntOut)
+	}
+	if f.TCPFlags != 0x10 {
+		t.Errorf("TCPFlags = %#x; want ACK", f.TCPFlags)
+	}
+	if f.SrcAs != 64512 || f.DstAs != 13335 {
+		t.Errorf("AS = %d -> %d; want 64512 -> 13335", f.SrcAs, f.DstAs)
+	}
+	select {
+	case c := <-ch:
+		if c.IfIndex != 3 || c.IfSpeed != 1000000000 || !c.AdminUp || !c.OperUp || c.InOctets != 123456789 || c.OutOctets != 987654321 || c.OutErrors != 4 {
+			t.Errorf("counters = %+v", c)
+		}
+	default:
+		t.Error("no counter sample")
+	}
+
+	if _, err := NewSFlow(nil).Decode(exporter, m.Bytes()[:40]); err == nil {
+		t.Error("Decode(truncated) succeeded; want error")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	localNets      = flag.String("internal_networks", "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7", "comma-separated CIDRs of the local network, to give flows a direction relative to, or empty to disable")
+	deviceFile     = flag.String("devices_file", "", "YAML or JSON file naming devices on the local network by address, reloaded on SIGHUP")
+	inventoryTopic = flag.String("mqtt_topic_inventory", "", "retained MQTT topic of a JSON list of devices, as in --devices_file, to name local addresses from; --devices_file takes precedence")
+
+	deviceAddrs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "ipfix",
+		Name:      "device_addresses",
+		Help:      "count of local addresses with device names, by source",
+	}, []string{"source"})
+)
+
+func init() {
+	prometheus.MustRegister(deviceAddrs)
+}
+
+// Device is a host on the local network, as listed in the devices file or
+// inventory topic. In YAML:
+//
+//	# devices.yaml
+//	- name: laptop
+//	  addresses:
+//	    - 192.168.8.68
+//	    - fd00::68
+type Device struct {
+	Name      string   `json:"name" yaml:"name"`
+	Addresses []string `json:"addresses" yaml:"addresses"`
+}
+
+// parseDevices returns device names by address from a list of devices in
+// JSON, or in YAML if yml is set.
+func parseDevices(b []byte, yml bool) (map[string]string, error) {
+	var devices []Device
+	var err error
+	if yml {
+		err = yaml.UnmarshalStrict(b, &devices)
+	} else {
+		err = json.Unmarshal(b, &devices)
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for i, d := range devices {
+		if d.Name == "" {
+			return nil, fmt.Errorf("device %d has no name", i)
+		}
+		for _, a := range d.Addresses {
+			ip := net.ParseIP(a)
+			switch {
+			case ip == nil:
+				return nil, fmt.Errorf("device %q has invalid address %q", d.Name, a)
+			case names[ip.String()] != "":
+				return nil, fmt.Errorf("device %q has address %s of device %q", d.Name, a, names[ip.String()])
+			}
+			names[ip.String()] = d.Name
+		}
+	}
+	return names, nil
+}
+
+// loadDevices reads a list of devices from a JSON file, if its name ends in
+// .json, or a YAML file otherwise.
+func loadDevices(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	names, err := parseDevices(b, filepath.Ext(path) != ".json")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return names, nil
+}
+
+// deviceTable looks up device names by address, from the devices file and
+// then the inventory topic. It is safe for concurrent use.
+type deviceTable struct {
+	mu              sync.RWMutex
+	file, inventory map[string]string
+}
+
+func (t *deviceTable) setFile(names map[string]string) {
+	t.mu.Lock()
+	t.file = names
+	t.mu.Unlock()
+	deviceAddrs.WithLabelValues("file").Set(float64(len(names)))
+}
+
+func (t *deviceTable) setInventory(names map[string]string) {
+	t.mu.Lock()
+	t.inventory = names
+	t.mu.Unlock()
+	deviceAddrs.WithLabelValues("inventory").Set(float64(len(names)))
+}
+
+// lookup returns the name of the device with address addr, or the empty
+// string if it isn't known.
+func (t *deviceTable) lookup(addr string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if name, ok := t.file[addr]; ok {
+		return name
+	}
+	return t.inventory[addr]
+}
+
+// watch reloads the devices file from path on SIGHUP. If the file can't be
+// loaded, the table is left unchanged.
+func (t *deviceTable) watch(path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		names, err := loadDevices(path)
+		if err != nil {
+			logrus.Errorf("not reloading devices: %v", err)
+			continue
+		}
+		t.setFile(names)
+		logrus.Infof("reloaded %d device addresses from %s", len(names), path)
+	}
+}
+
+// handleInventory replaces the inventory with a JSON list of devices. An
+// empty message, which clears a retained topic, empties it.
+func (t *deviceTable) handleInventory(_ paho.Client, m paho.Message) {
+	if len(m.Payload()) == 0 {
+		t.setInventory(nil)
+		return
+	}
+	names, err := parseDevices(m.Payload(), false)
+	if err != nil {
+		logrus.Errorf("not updating inventory from %s: %v", m.Topic(), err)
+		return
+	}
+	t.setInventory(names)
+	logrus.Infof("updated %d device addresses from %s", len(names), m.Topic())
+}
+
+// parseNets parses a comma-separated list of CIDRs.
+func parseNets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// attributor marks the endpoints of records as internal or external to the
+// local network, gives them a direction relative to it, and names the
+// devices at internal endpoints.
+type attributor struct {
+	local   []*net.IPNet
+	devices *deviceTable
+}
+
+func (a *attributor) internal(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.local {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *attributor) process(r *Record) {
+	r.SrcInternal, r.DstInternal = a.internal(r.SrcAddr), a.internal(r.DstAddr)
+	r.Direction = direction(r.SrcInternal, r.DstInternal)
+	if r.SrcInternal {
+		r.SrcDevice = a.devices.lookup(r.SrcAddr)
+	}
+	if r.DstInternal {
+		r.DstDevice = a.devices.lookup(r.DstAddr)
+	}
+}
+
+// direction returns the direction of traffic relative to the local network,
+// given whether its source and destination are internal to it.
+func direction(src, dst bool) string {
+	switch {
+	case src && dst:
+		return "internal"
+	case src:
+		return "outbound"
+	case dst:
+		return "inbound"
+	}
+	return "transit"
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type message struct {
+	topic   string
+	payload []byte
+}
+
+func (m message) Duplicate() bool   { return false }
+func (m message) Qos() byte         { return 1 }
+func (m message) Retained() bool    { return true }
+func (m message) Topic() string     { return m.topic }
+func (m message) MessageID() uint16 { return 0 }
+func (m message) Payload() []byte   { return m.payload }
+func (m message) Ack()              {}
+
+func TestLoadDevices(t *testing.T) {
+	dir := t.TempDir()
+	for name, c := range map[string]struct {
+		content string
+		ok      bool
+	}{
+		"devices.yaml":    {"- name: laptop\n  addresses: [192.168.8.68, 'fd00::68']\n- name: tv\n  addresses: [192.168.8.70]\n", true},
+		"devices.json":    {`[{"name": "laptop", "addresses": ["192.168.8.68", "fd00:0::68"]}, {"name": "tv", "addresses": ["192.168.8.70"]}]`, true},
+		"noname.yaml":     {"- addresses: [192.168.8.68]\n", false},
+		"badaddr.yaml":    {"- name: laptop\n  addresses: [192.168.8]\n", false},
+		"duplicate.yaml":  {"- name: laptop\n  addresses: [192.168.8.68]\n- name: tv\n  addresses: [192.168.8.68]\n", false},
+		"unknownkey.yaml": {"- name: laptop\n  mac: 00:11:22:33:44:55\n", false},
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names, err := loadDevices(path)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%s: loaded %v", name, names)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		want := map[string]string{"192.168.8.68": "laptop", "fd00::68": "laptop", "192.168.8.70": "tv"}
+		if len(names) != len(want) {
+			t.Errorf("%s: got %v, want %v", name, names, want)
+		}
+		for k, v := range want {
+			if names[k] != v {
+				t.Errorf("%s: got %v, want %v", name, names, want)
+			}
+		}
+	}
+}
+
+func TestAttributor(t *testing.T) {
+	local, err := parseNets("192.168.8.0/24, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := &deviceTable{}
+	devices.setFile(map[string]string{"192.168.8.68": "laptop"})
+	devices.handleInventory(nil, message{"inventory", []byte(`[{"name": "tv", "addresses": ["192.168.8.70"]}, {"name": "old-laptop", "addresses": ["192.168.8.68"]}]`)})
+	a := &attributor{local: local, devices: devices}
+	for _, c := range []struct {
+		src, dst, direction, srcDevice, dstDevice string
+	}{
+		{"192.168.8.68", "1.1.1.1", "outbound", "laptop", ""},
+		{"1.1.1.1", "192.168.8.70", "inbound", "", "tv"},
+		{"192.168.8.70", "fd00::1", "internal", "tv", ""},
+		{"1.1.1.1", "8.8.8.8", "transit", "", ""},
+	} {
+		r := &Record{SrcAddr: c.src, DstAddr: c.dst}
+		a.process(r)
+		if r.Direction != c.direction || r.SrcDevice != c.srcDevice || r.DstDevice != c.dstDevice {
+			t.Errorf("%s -> %s: got %q %q %q, want %q %q %q", c.src, c.dst, r.Direction, r.SrcDevice, r.DstDevice, c.direction, c.srcDevice, c.dstDevice)
+		}
+	}
+
+	// a bad inventory is ignored, and an empty one clears it
+	devices.handleInventory(nil, message{"inventory", []byte(`{`)})
+	if got := devices.lookup("192.168.8.70"); got != "tv" {
+		t.Errorf("lookup after bad inventory = %q, want tv", got)
+	}
+	devices.handleInventory(nil, message{"inventory", nil})
+	if got := devices.lookup("192.168.8.70"); got != "" {
+		t.Errorf("lookup after empty inventory = %q, want nothing", got)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"time"
+
+	"github.com/dichro/pubsub-logging/enrich"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	enrichDBs    = flag.String("enrich_databases", "", "comma-separated MaxMind .mmdb or ip2asn .tsv[.gz] files to look up flow addresses in; earlier files take precedence")
+	enrichReload = flag.Duration("enrich_reload", time.Minute, "how often to check enrichment databases for changes")
+	enrichCache  = flag.Int("enrich_cache_size", 100000, "number of addresses to cache enrichment lookups for")
+)
+
+// enricher annotates records with the country, city and AS of their
+// addresses. AS numbers from the exporter are kept.
+type enricher struct {
+	e *enrich.Enricher
+}
+
+func (e *enricher) process(r *Record) {
+	if info, ok := e.e.Lookup(net.ParseIP(r.SrcAddr)); ok {
+		r.SrcCountry, r.SrcCity = info.Country, info.City
+		r.SrcAS, r.SrcASOrg = asn(r.SrcAS, info)
+	}
+	if info, ok := e.e.Lookup(net.ParseIP(r.DstAddr)); ok {
+		r.DstCountry, r.DstCity = info.Country, info.City
+		r.DstAS, r.DstASOrg = asn(r.DstAS, info)
+	}
+}
+
+// asn returns the AS number and organisation for an address the exporter
+// reported as being in AS exported, if any.
+func asn(exported uint32, info enrich.Info) (uint32, string) {
+	if exported != 0 && exported != info.ASN {
+		return exported, ""
+	}
+	return info.ASN, info.ASOrg
+}
+
+// watchEnricher reloads enrichment databases as they change.
+func watchEnricher(e *enrich.Enricher, interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, errs := e.Reload()
+		for _, err := range errs {
+			logrus.Error(err)
+		}
+		for _, path := range reloaded {
+			logrus.Infof("reloaded enrichment database %s", path)
+		}
+	}
+}
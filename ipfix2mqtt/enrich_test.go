@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dichro/pubsub-logging/enrich"
+)
+
+func TestEnricher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip2asn.tsv")
+	if err := os.WriteFile(path, []byte("1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n8.8.8.0\t8.8.8.255\t15169\tUS\tGOOGLE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := enrich.Open([]string{path}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	r := &Record{SrcAddr: "192.168.8.68", DstAddr: "1.0.0.1"}
+	(&enricher{e}).process(r)
+	if r.SrcCountry != "" || r.SrcAS != 0 || r.DstCountry != "US" || r.DstAS != 13335 || r.DstASOrg != "CLOUDFLARENET" {
+		t.Errorf("unexpected enrichment: %+v", r)
+	}
+	// the exporter's AS wins, without the database's organisation
+	r = &Record{SrcAddr: "8.8.8.8", SrcAS: 64496}
+	(&enricher{e}).process(r)
+	if r.SrcCountry != "US" || r.SrcAS != 64496 || r.SrcASOrg != "" {
+		t.Errorf("unexpected enrichment: %+v", r)
+	}
+}
@@ -1,18 +1,25 @@
-// This program receives IPFIX messages and publishes them as JSON on an MQTT topic.
+// This program receives IPFIX, NetFlow v5, NetFlow v9 and sFlow v5 messages
+// and publishes them as JSON on an MQTT topic.
 package main
 
 import (
 	"bytes"
 	"encoding/json"
 	"flag"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/bio-routing/tflow2/config"
 	"github.com/bio-routing/tflow2/netflow"
 	"github.com/bio-routing/tflow2/nfserver"
 	"github.com/bio-routing/tflow2/srcache"
+	"github.com/dichro/pubsub-logging/enrich"
+	"github.com/dichro/pubsub-logging/ipfix2mqtt/collector"
 	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
@@ -24,24 +31,63 @@ var (
 	agentName = flag.String("agent_name", "agent", "name of Netflow agent")
 	agentIP   = flag.String("agent_ip", "", "ip of Netflow agent")
 	agentSR   = flag.Int64("agent_sample_rate", 1, "sampling rate for Netflow agent")
-	nfAddr    = flag.String("netflow_listen", ":2055", "[address]:port to listen for Netflow v9 packets on")
+	agentFile = flag.String("agents_file", "", "YAML or JSON file listing Netflow agents, reloaded on SIGHUP, except that adding agents needs a restart while --netflow_listen is enabled; overrides --agent_name, --agent_ip and --agent_sample_rate")
+	nfAddr    = flag.String("netflow_listen", ":2055", "[address]:port to listen for Netflow v9 packets on, or empty to disable")
+	nf5Addr   = flag.String("netflow5_listen", ":2056", "[address]:port to listen for Netflow v5 packets on, or empty to disable")
+	ipfixAddr = flag.String("ipfix_listen", ":4739", "[address]:port to listen for IPFIX packets on, or empty to disable")
+	sflowAddr = flag.String("sflow_listen", ":6343", "[address]:port to listen for sFlow v5 packets on, or empty to disable")
+	tmplTTL   = flag.Duration("ipfix_template_timeout", 30*time.Minute, "how long to keep IPFIX templates that aren't refreshed")
 	httpAddr  = flag.String("http_listen", ":8080", "[address]:port to listen on for http requests")
 	mqttAddr  = flag.String("mqtt_address", "tcp://mqtt:1883", "address of MQTT broker")
-	mqttTopic = flag.String("mqtt_topic", "ipfix/raw/json", "MQTT topic to publish raw IPFIX messages")
+	mqttTopic = flag.String("mqtt_topic", "ipfix/raw/json", "MQTT topic to publish flow records, or empty to disable")
+	rawOutput = flag.Bool("raw_output", false, "publish flow records as decoded, with binary addresses and numeric codes, instead of normalised. Either way, NetFlow v9 records have no start or end times, TCP flags or direction")
+	ctrTopic  = flag.String("mqtt_topic_counters", "ipfix/counters/json", "MQTT topic to publish sFlow interface counter samples, or empty to disable")
+	redactCfg = flag.String("redact_config", "", "JSON file of redaction rules to apply before publishing")
 )
 
 func main() {
 	flag.Parse()
-	enabled := true
-	agents := []config.Agent{
-		{Name: *agentName, IPAddress: *agentIP, SampleRate: uint64(*agentSR)},
-	}
-	nameByIP := make(map[string]string)
-	for _, a := range agents {
-		nameByIP[a.IPAddress] = a.Name
-	}
+	enabled := len(*nfAddr) > 0
 	logrus.SetOutput(os.Stderr)
 	logrus.SetLevel(logrus.TraceLevel)
+	var table *agentTable
+	if len(*agentFile) > 0 {
+		a, err := loadAgents(*agentFile)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("loaded %d agents from %s", len(a), *agentFile)
+		table = newAgentTable(a)
+	} else {
+		ip := *agentIP
+		if len(ip) > 0 {
+			parsed := net.ParseIP(ip)
+			if parsed == nil {
+				logrus.Fatalf("invalid --agent_ip %q", ip)
+			}
+			// as in the agents file, so that lookups match
+			ip = parsed.String()
+		}
+		table = newAgentTable([]Agent{{Name: *agentName, IP: ip, SampleRate: uint64(*agentSR)}})
+		if len(ip) == 0 {
+			// accept flows from anywhere, as before there was an agents file
+			table.fallback = &Agent{Name: *agentName, SampleRate: uint64(*agentSR)}
+		}
+	}
+	agents, nameByIP := tflow2Agents(table.all())
+	r, err := redact.Load(*redactCfg)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	sr := srcache.New(agents)
+	if len(*agentFile) > 0 {
+		var fixed map[string]string
+		if enabled {
+			// the tflow2 collector only accepts the agents it started with
+			fixed = nameByIP
+		}
+		go table.watch(*agentFile, sr, fixed)
+	}
 	s := nfserver.New(10, &config.Config{
 		NetflowV9: &config.Server{
 			Enabled: &enabled,
@@ -50,17 +96,113 @@ func main() {
 		BGPAugmentation: &config.BGPAugment{},
 		Agents:          agents,
 		AgentsNameByIP:  nameByIP,
-	}, srcache.New(agents))
+	}, sr)
+
+	local, err := parseNets(*localNets)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	devices := &deviceTable{}
+	if len(*deviceFile) > 0 {
+		names, err := loadDevices(*deviceFile)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("loaded %d device addresses from %s", len(names), *deviceFile)
+		devices.setFile(names)
+		go devices.watch(*deviceFile)
+	}
 
 	opts := paho.NewClientOptions()
 	opts.AddBroker(*mqttAddr)
 	opts.SetAutoReconnect(true)
+	if len(*inventoryTopic) > 0 {
+		// subscriptions don't survive reconnection
+		opts.SetOnConnectHandler(func(c paho.Client) {
+			if token := c.Subscribe(*inventoryTopic, 1, devices.handleInventory); token.Wait() && token.Error() != nil {
+				logrus.Error(token.Error())
+			}
+		})
+	}
 	mqtt := paho.NewClient(opts)
 	if token := mqtt.Connect(); token.Wait() && token.Error() != nil {
 		logrus.Fatal(token.Error())
 	}
 	logrus.Info("connected")
-	go decode(pub.New(mqtt, 1, false), s.Output)
+	ch := make(chan *collector.Flow)
+	go func() {
+		for f := range s.Output {
+			// tflow2 doesn't decode times, TCP flags or direction
+			ch <- &collector.Flow{Flow: f, ExporterProtocol: "netflow_v9"}
+		}
+	}()
+	if len(*nf5Addr) > 0 {
+		go func() {
+			logrus.Fatal(collector.Listen(*nf5Addr, collector.NetflowV5{}, ch))
+		}()
+	}
+	if len(*ipfixAddr) > 0 {
+		go func() {
+			logrus.Fatal(collector.Listen(*ipfixAddr, collector.NewIPFIX(*tmplTTL), ch))
+		}()
+	}
+	p := pub.New(mqtt, 1, false)
+	if len(*sflowAddr) > 0 {
+		var counters chan *collector.Counters
+		if len(*ctrTopic) > 0 {
+			counters = make(chan *collector.Counters)
+			go publishCounters(p, r, table, counters)
+		}
+		go func() {
+			logrus.Fatal(collector.Listen(*sflowAddr, collector.NewSFlow(counters), ch))
+		}()
+	}
+	// stages that annotate records must come before those that consume them
+	var stages []stage
+	if len(local) > 0 {
+		stages = append(stages, &attributor{local: local, devices: devices})
+	}
+	if len(*enrichDBs) > 0 {
+		e, err := enrich.Open(strings.Split(*enrichDBs, ","), *enrichCache)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		go watchEnricher(e, *enrichReload)
+		stages = append(stages, &enricher{e})
+	}
+	if len(*biflowTopic) > 0 {
+		if *biflowMax <= 0 {
+			logrus.Fatal("--biflow_max_pending must be positive")
+		}
+		st := newStitcher(p, r, *biflowTimeout, *biflowMax)
+		go st.run()
+		stages = append(stages, st)
+	}
+	if len(*alertTopic) > 0 {
+		if *scanMax <= 0 {
+			logrus.Fatal("--scan_max_tracked must be positive")
+		}
+		d := newDetector(p, r, *scanWindow, *scanMax)
+		go d.run()
+		stages = append(stages, d)
+	}
+	if *aggInterval > 0 {
+		agg, err := newAggregator(p, r, *aggKeys)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		go agg.run(*aggInterval)
+		stages = append(stages, agg)
+	}
+	if *usageInterval > 0 {
+		if len(local) == 0 {
+			logrus.Fatal("--usage_interval requires --internal_networks")
+		}
+		acct := newAccountant(p, r, time.Now())
+		go acct.run(*usageInterval)
+		stages = append(stages, acct)
+	}
+	go decode(p, r, table, stages, ch)
 
 	http.Handle("/metrics", promhttp.Handler())
 	logrus.Fatal(http.ListenAndServe(*httpAddr, nil))
@@ -84,15 +226,105 @@ func init() {
 	prometheus.MustRegister(dropCount)
 }
 
-func decode(p *pub.Publisher, ch <-chan *netflow.Flow) {
+// Flow is a flow record as published with --raw_output.
+type Flow struct {
+	*netflow.Flow
+	ExporterProtocol string            `json:"exporter_protocol"`
+	Enterprise       map[string]string `json:"enterprise,omitempty"`
+	Agent            string            `json:"agent"`
+	Site             string            `json:"site,omitempty"`
+	InterfaceIn      string            `json:"interface_in,omitempty"`
+	InterfaceOut     string            `json:"interface_out,omitempty"`
+}
+
+// A stage consumes normalised flow records before they are published, and
+// may annotate them.
+type stage interface {
+	process(r *Record)
+}
+
+// encode returns v as redacted JSON.
+func encode(r *redact.Redactor, v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return r.JSON(buf.Bytes())
+}
+
+func decode(p *pub.Publisher, r *redact.Redactor, agents *agentTable, stages []stage, ch <-chan *collector.Flow) {
 	for msg := range ch {
 		messageCount.Inc()
-		var buf bytes.Buffer
-		if err := json.NewEncoder(&buf).Encode(msg); err != nil {
+		a := agents.lookup(net.IP(msg.Router))
+		if a == nil {
+			dropCount.Inc()
+			agentFlows.WithLabelValues(unknownAgent, "dropped").Inc()
+			continue
+		}
+		agentFlows.WithLabelValues(a.Name, "received").Inc()
+		if msg.Samplerate == 0 {
+			msg.Samplerate = a.SampleRate
+		}
+		rec := normalise(msg, a)
+		for _, s := range stages {
+			s.process(rec)
+		}
+		if len(*mqttTopic) == 0 {
+			agentFlows.WithLabelValues(a.Name, "decoded").Inc()
+			continue
+		}
+		var v interface{} = rec
+		if *rawOutput {
+			v = &Flow{
+				Flow:             msg.Flow,
+				ExporterProtocol: msg.ExporterProtocol,
+				Enterprise:       msg.Enterprise,
+				Agent:            a.Name,
+				Site:             a.Site,
+				InterfaceIn:      a.Interfaces[msg.IntIn],
+				InterfaceOut:     a.Interfaces[msg.IntOut],
+			}
+		}
+		out, err := encode(r, v)
+		if err != nil {
+			dropCount.Inc()
+			agentFlows.WithLabelValues(a.Name, "dropped").Inc()
+			logrus.Error(err)
+			continue
+		}
+		agentFlows.WithLabelValues(a.Name, "decoded").Inc()
+		go p.Publish(*mqttTopic, out)
+	}
+}
+
+// InterfaceCounters is an interface counter sample as published.
+type InterfaceCounters struct {
+	*collector.Counters
+	// Router is the agent address, as in Records.
+	Router    string `json:"router"`
+	Agent     string `json:"agent"`
+	Site      string `json:"site,omitempty"`
+	Interface string `json:"interface,omitempty"`
+}
+
+func publishCounters(p *pub.Publisher, r *redact.Redactor, agents *agentTable, ch <-chan *collector.Counters) {
+	for c := range ch {
+		a := agents.lookup(net.IP(c.Router))
+		if a == nil {
 			dropCount.Inc()
+			continue
+		}
+		out, err := encode(r, &InterfaceCounters{
+			Counters:  c,
+			Router:    ipString(c.Router),
+			Agent:     a.Name,
+			Site:      a.Site,
+			Interface: a.Interfaces[c.IfIndex],
+		})
+		if err != nil {
 			logrus.Error(err)
 			continue
 		}
-		go p.Publish(*mqttTopic, buf.Bytes())
+		go p.Publish(*ctrTopic, out)
 	}
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/bio-routing/tflow2/netflow"
+	"github.com/dichro/pubsub-logging/ipfix2mqtt/collector"
+)
+
+// Record is a normalised flow record, with addresses and protocols rendered
+// as strings and counters scaled up by the sampling rate.
+type Record struct {
+	Timestamp        time.Time         `json:"timestamp"`
+	ExporterProtocol string            `json:"exporter_protocol"`
+	Agent            string            `json:"agent"`
+	Site             string            `json:"site,omitempty"`
+	Router           string            `json:"router"`
+	Family           string            `json:"family,omitempty"`
+	Protocol         string            `json:"protocol"`
+	SrcAddr          string            `json:"src_addr,omitempty"`
+	DstAddr          string            `json:"dst_addr,omitempty"`
+	SrcPrefix        string            `json:"src_prefix,omitempty"`
+	DstPrefix        string            `json:"dst_prefix,omitempty"`
+	SrcPort          uint32            `json:"src_port,omitempty"`
+	DstPort          uint32            `json:"dst_port,omitempty"`
+	Service          string            `json:"service,omitempty"`
+	TCPFlags         []string          `json:"tcp_flags,omitempty"`
+	NextHop          string            `json:"next_hop,omitempty"`
+	SrcAS            uint32            `json:"src_as,omitempty"`
+	DstAS            uint32            `json:"dst_as,omitempty"`
+	SrcCountry       string            `json:"src_country,omitempty"`
+	SrcCity          string            `json:"src_city,omitempty"`
+	SrcASOrg         string            `json:"src_as_org,omitempty"`
+	DstCountry       string            `json:"dst_country,omitempty"`
+	DstCity          string            `json:"dst_city,omitempty"`
+	DstASOrg         string            `json:"dst_as_org,omitempty"`
+	InterfaceIn      uint32            `json:"if_in,omitempty"`
+	InterfaceOut     uint32            `json:"if_out,omitempty"`
+	InterfaceInName  string            `json:"if_in_name,omitempty"`
+	InterfaceOutName string            `json:"if_out_name,omitempty"`
+	FlowDirection    string            `json:"flow_direction,omitempty"`
+	Start            *time.Time        `json:"start,omitempty"`
+	End              *time.Time        `json:"end,omitempty"`
+	Duration         float64           `json:"duration_seconds,omitempty"`
+	Bytes            uint64            `json:"bytes"`
+	Packets          uint64            `json:"packets"`
+	SampleRate       uint64            `json:"sample_rate"`
+	Enterprise       map[string]string `json:"enterprise,omitempty"`
+
+	// SrcInternal and DstInternal are set for addresses in
+	// --internal_networks, and Direction is the flow's direction relative to
+	// them: inbound, outbound, internal or transit.
+	SrcInternal bool   `json:"src_internal,omitempty"`
+	DstInternal bool   `json:"dst_internal,omitempty"`
+	Direction   string `json:"direction,omitempty"`
+	SrcDevice   string `json:"src_device,omitempty"`
+	DstDevice   string `json:"dst_device,omitempty"`
+}
+
+// normalise returns the normalised form of a flow from agent a.
+func normalise(f *collector.Flow, a *Agent) *Record {
+	r := &Record{
+		Timestamp:        time.Unix(f.Timestamp, 0).UTC(),
+		ExporterProtocol: f.ExporterProtocol,
+		Agent:            a.Name,
+		Site:             a.Site,
+		Router:           ipString(f.Router),
+		Protocol:         protocolName(f.Protocol),
+		SrcAddr:          ipString(f.SrcAddr),
+		DstAddr:          ipString(f.DstAddr),
+		SrcPrefix:        prefixString(f.SrcPfx),
+		DstPrefix:        prefixString(f.DstPfx),
+		SrcPort:          f.SrcPort,
+		DstPort:          f.DstPort,
+		Service:          service(f.Protocol, f.SrcPort, f.DstPort),
+		NextHop:          ipString(f.NextHop),
+		SrcAS:            f.SrcAs,
+		DstAS:            f.DstAs,
+		InterfaceIn:      f.IntIn,
+		InterfaceOut:     f.IntOut,
+		InterfaceInName:  a.Interfaces[f.IntIn],
+		InterfaceOutName: a.Interfaces[f.IntOut],
+		FlowDirection:    f.Direction,
+		SampleRate:       f.Samplerate,
+		Enterprise:       f.Enterprise,
+	}
+	switch f.Family {
+	case 4:
+		r.Family = "ipv4"
+	case 6:
+		r.Family = "ipv6"
+	}
+	if f.Protocol == protoTCP {
+		r.TCPFlags = tcpFlagNames(f.TCPFlags)
+	}
+	if !f.Start.IsZero() && !f.End.IsZero() {
+		start, end := f.Start.UTC(), f.End.UTC()
+		r.Start, r.End = &start, &end
+		r.Duration = end.Sub(start).Seconds()
+	}
+	rate := f.Samplerate
+	if rate == 0 {
+		rate = 1
+	}
+	r.Bytes, r.Packets = f.Size*rate, f.Packets*rate
+	return r
+}
+
+// ipString renders a binary address, or returns the empty string if b is
+// empty.
+func ipString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return net.IP(b).String()
+}
+
+func prefixString(p *netflow.Pfx) string {
+	if p == nil || len(p.IP) == 0 || len(p.Mask) == 0 {
+		return ""
+	}
+	return (&net.IPNet{IP: p.IP, Mask: p.Mask}).String()
+}
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+var protocolNames = map[uint32]string{
+	1:   "icmp",
+	2:   "igmp",
+	4:   "ipip",
+	6:   "tcp",
+	17:  "udp",
+	41:  "ipv6",
+	47:  "gre",
+	50:  "esp",
+	51:  "ah",
+	58:  "ipv6-icmp",
+	89:  "ospf",
+	103: "pim",
+	112: "vrrp",
+	132: "sctp",
+}
+
+// protocolName returns the IANA keyword for an IP protocol number, or the
+// number itself if it isn't well known.
+func protocolName(p uint32) string {
+	if name, ok := protocolNames[p]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(p), 10)
+}
+
+// serviceNames maps well-known TCP and UDP ports to IANA service names.
+var serviceNames = map[uint32]string{
+	20:   "ftp-data",
+	21:   "ftp",
+	22:   "ssh",
+	23:   "telnet",
+	25:   "smtp",
+	53:   "domain",
+	67:   "bootps",
+	68:   "bootpc",
+	69:   "tftp",
+	80:   "http",
+	110:  "pop3",
+	123:  "ntp",
+	137:  "netbios-ns",
+	138:  "netbios-dgm",
+	139:  "netbios-ssn",
+	143:  "imap",
+	161:  "snmp",
+	162:  "snmptrap",
+	179:  "bgp",
+	389:  "ldap",
+	443:  "https",
+	445:  "microsoft-ds",
+	465:  "submissions",
+	500:  "isakmp",
+	514:  "syslog",
+	587:  "submission",
+	636:  "ldaps",
+	853:  "domain-s",
+	993:  "imaps",
+	995:  "pop3s",
+	1194: "openvpn",
+	1883: "mqtt",
+	3306: "mysql",
+	3389: "ms-wbt-server",
+	3478: "stun",
+	4500: "ipsec-nat-t",
+	5353: "mdns",
+	5432: "postgresql",
+	8080: "http-alt",
+	8883: "secure-mqtt",
+}
+
+// service returns the name of the well-known service a TCP or UDP flow is
+// for, preferring the destination port, or the empty string.
+func service(proto, src, dst uint32) string {
+	if proto != protoTCP && proto != protoUDP {
+		return ""
+	}
+	if name, ok := serviceNames[dst]; ok {
+		return name
+	}
+	return serviceNames[src]
+}
+
+var tcpFlagBits = []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"}
+
+// tcpFlagNames returns the names of the TCP flags set in flags.
+func tcpFlagNames(flags uint8) []string {
+	var names []string
+	for i, name := range tcpFlagBits {
+		if flags&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
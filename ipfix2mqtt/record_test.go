@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bio-routing/tflow2/netflow"
+	"github.com/dichro/pubsub-logging/ipfix2mqtt/collector"
+)
+
+func TestNormalise(t *testing.T) {
+	start := time.Date(2020, 2, 17, 19, 52, 34, 0, time.UTC)
+	f := &collector.Flow{
+		Flow: &netflow.Flow{
+			Router:     net.ParseIP("192.168.8.1").To4(),
+			Family:     4,
+			SrcAddr:    net.ParseIP("104.21.1.1").To4(),
+			DstAddr:    net.ParseIP("192.168.8.68").To4(),
+			DstPfx:     &netflow.Pfx{IP: net.ParseIP("192.168.8.0").To4(), Mask: net.CIDRMask(24, 32)},
+			Protocol:   6,
+			SrcPort:    443,
+			DstPort:    50123,
+			IntIn:      1,
+			IntOut:     2,
+			Timestamp:  start.Add(3 * time.Second).Unix(),
+			Samplerate: 100,
+			Packets:    2,
+			Size:       3000,
+		},
+		ExporterProtocol: "ipfix",
+		TCPFlags:         0x12,
+		Direction:        "ingress",
+		Start:            start,
+		End:              start.Add(1500 * time.Millisecond),
+	}
+	a := &Agent{Name: "gw", Site: "home", Interfaces: map[uint32]string{1: "wan", 2: "lan"}}
+	r := normalise(f, a)
+	for name, c := range map[string][2]interface{}{
+		"Agent":     {r.Agent, "gw"},
+		"Router":    {r.Router, "192.168.8.1"},
+		"Family":    {r.Family, "ipv4"},
+		"Protocol":  {r.Protocol, "tcp"},
+		"SrcAddr":   {r.SrcAddr, "104.21.1.1"},
+		"DstPrefix": {r.DstPrefix, "192.168.8.0/24"},
+		"Service":   {r.Service, "https"},
+		"TCPFlags":  {r.TCPFlags, []string{"SYN", "ACK"}},
+		"IfIn":      {r.InterfaceInName, "wan"},
+		"IfOut":     {r.InterfaceOutName, "lan"},
+		"Direction": {r.FlowDirection, "ingress"},
+		"Duration":  {r.Duration, 1.5},
+		"Bytes":     {r.Bytes, uint64(300000)},
+		"Packets":   {r.Packets, uint64(200)},
+	} {
+		if !reflect.DeepEqual(c[0], c[1]) {
+			t.Errorf("%s = %v; want %v", name, c[0], c[1])
+		}
+	}
+
+	f.Protocol, f.Samplerate = 250, 0
+	r = normalise(f, a)
+	if r.Protocol != "250" || r.Service != "" || r.TCPFlags != nil || r.Bytes != 3000 {
+		t.Errorf("unknown protocol: protocol %q service %q flags %v bytes %d", r.Protocol, r.Service, r.TCPFlags, r.Bytes)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	alertTopic     = flag.String("mqtt_topic_alerts", "", "MQTT topic to publish port scan and fan-out alerts, or empty to disable")
+	scanWindow     = flag.Duration("scan_window", 5*time.Minute, "length of the sliding window to count scan and fan-out targets over")
+	scanHorizontal = flag.Int("scan_horizontal", 100, "number of hosts a source must connect to on one port within --scan_window to be a horizontal scan, or 0 to disable")
+	scanVertical   = flag.Int("scan_vertical", 100, "number of ports a source must connect to on one host within --scan_window to be a vertical scan, or 0 to disable")
+	scanFanout     = flag.Int("scan_fanout", 1000, "number of hosts an internal source must connect to within --scan_window to be an unusual fan-out, or 0 to disable")
+	scanMax        = flag.Int("scan_max_tracked", 100000, "maximum number of sources, ports and hosts to count targets for, beyond which the least recently active are forgotten")
+
+	alertCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "ipfix",
+		Name:      "alerts",
+		Help:      "count of alerts published, by kind",
+	}, []string{"kind"})
+	scanTracked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "ipfix",
+		Name:      "scan_tracked",
+		Help:      "count of sources, ports and hosts targets are being counted for",
+	})
+	scanEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "ipfix",
+		Name:      "scan_evicted",
+		Help:      "count of sources, ports and hosts forgotten because --scan_max_tracked was reached",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(alertCount)
+	prometheus.MustRegister(scanTracked)
+	prometheus.MustRegister(scanEvicted)
+}
+
+// Alert kinds.
+const (
+	horizontalScan = "horizontal_scan"
+	verticalScan   = "vertical_scan"
+	fanOut         = "fan_out"
+)
+
+// maxExamples is the number of targets listed in an alert.
+const maxExamples = 10
+
+// Alert reports a source connecting to more targets than its threshold
+// within a window: hosts on one port for a horizontal scan, ports on one
+// host for a vertical scan, or hosts on any port for a fan-out.
+type Alert struct {
+	Timestamp    time.Time `json:"timestamp"`
+	Kind         string    `json:"kind"`
+	Agent        string    `json:"agent"`
+	Source       string    `json:"source"`
+	SourceDevice string    `json:"source_device,omitempty"`
+	Protocol     string    `json:"protocol,omitempty"`
+	// Port is the port scanned, for horizontal scans.
+	Port uint32 `json:"port,omitempty"`
+	// Host is the host scanned, for vertical scans.
+	Host        string    `json:"host,omitempty"`
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+	// Targets is the number of distinct hosts or ports connected to in the
+	// window, and Examples some of them.
+	Targets   int      `json:"targets"`
+	Threshold int      `json:"threshold"`
+	Examples  []string `json:"examples"`
+	Flows     uint64   `json:"flows"`
+	Bytes     uint64   `json:"bytes"`
+	Packets   uint64   `json:"packets"`
+}
+
+type trackKey struct {
+	kind, agent, source, protocol string
+	port                          uint32
+	host                          string
+}
+
+type hit struct {
+	last                  time.Time
+	flows, bytes, packets uint64
+}
+
+// track counts the distinct targets of a source within the window.
+type track struct {
+	key     trackKey
+	device  string
+	targets map[string]*hit
+	alerted time.Time
+}
+
+// prune drops targets last seen before cutoff.
+func (t *track) prune(cutoff time.Time) {
+	for k, h := range t.targets {
+		if h.last.Before(cutoff) {
+			delete(t.targets, k)
+		}
+	}
+}
+
+// firstPort is the only port a source has connected to on a host, before
+// the host is tracked for vertical scans.
+type firstPort struct {
+	key  trackKey
+	port string
+	hit  *hit
+}
+
+// detector publishes Alerts for sources of flows connecting to too many
+// targets. Only flows from the initiator of a connection are counted, so
+// that busy servers aren't taken for scanners. Each source is alerted on at
+// most once per window for each kind, port or host.
+//
+// At most max tracks are kept, forgetting the least recently active. As most
+// sources connect to only one port on each host, hosts aren't tracked for
+// vertical scans until a source connects to a second port on them; until
+// then, up to max first ports are remembered instead.
+type detector struct {
+	pub    *pub.Publisher
+	redact *redact.Redactor
+	window time.Duration
+	max    int
+
+	mu sync.Mutex
+	// tracks holds *track elements of active, and firsts *firstPort
+	// elements of pending, each in order of activity.
+	tracks          map[trackKey]*list.Element
+	firsts          map[trackKey]*list.Element
+	active, pending *list.List
+}
+
+func newDetector(p *pub.Publisher, r *redact.Redactor, window time.Duration, max int) *detector {
+	return &detector{
+		pub:     p,
+		redact:  r,
+		window:  window,
+		max:     max,
+		tracks:  make(map[trackKey]*list.Element),
+		firsts:  make(map[trackKey]*list.Element),
+		active:  list.New(),
+		pending: list.New(),
+	}
+}
+
+func (d *detector) process(r *Record) {
+	for _, a := range d.add(r, time.Now()) {
+		alertCount.WithLabelValues(a.Kind).Inc()
+		out, err := encode(d.redact, a)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		go d.pub.Publish(*alertTopic, out)
+	}
+}
+
+// add counts the targets of a flow seen at time now, and returns any alerts
+// it triggers.
+func (d *detector) add(r *Record, now time.Time) []*Alert {
+	if r.SrcAddr == "" || r.DstAddr == "" {
+		return nil
+	}
+	if fromSrc, _ := initiator(r, nil); !fromSrc {
+		return nil
+	}
+	ported := r.Protocol == "tcp" || r.Protocol == "udp"
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var alerts []*Alert
+	check := func(key trackKey, target string, threshold int) {
+		if threshold <= 0 {
+			return
+		}
+		if a := d.count(key, r, target, threshold, now); a != nil {
+			alerts = append(alerts, a)
+		}
+	}
+	if ported {
+		check(trackKey{kind: horizontalScan, agent: r.Agent, source: r.SrcAddr, protocol: r.Protocol, port: r.DstPort}, r.DstAddr, *scanHorizontal)
+		key := trackKey{kind: verticalScan, agent: r.Agent, source: r.SrcAddr, protocol: r.Protocol, host: r.DstAddr}
+		port := strconv.FormatUint(uint64(r.DstPort), 10)
+		if *scanVertical <= 1 || d.secondPort(key, r, port, now) {
+			check(key, port, *scanVertical)
+		}
+	}
+	if r.SrcInternal {
+		check(trackKey{kind: fanOut, agent: r.Agent, source: r.SrcAddr}, r.DstAddr, *scanFanout)
+	}
+	scanTracked.Set(float64(len(d.tracks)))
+	return alerts
+}
+
+// secondPort reports whether key, a vertical scan track, should count a flow
+// to port: if it's already tracked, or port is the second seen. Otherwise, it
+// remembers port as the first.
+func (d *detector) secondPort(key trackKey, r *Record, port string, now time.Time) bool {
+	if _, ok := d.tracks[key]; ok {
+		return true
+	}
+	e, ok := d.firsts[key]
+	if !ok {
+		for d.max > 0 && d.pending.Len() >= d.max {
+			d.forgetFirst(d.pending.Front())
+		}
+		d.firsts[key] = d.pending.PushBack(&firstPort{key: key, port: port, hit: &hit{}})
+		e = d.firsts[key]
+	}
+	f := e.Value.(*firstPort)
+	if f.port != port {
+		// the first port is counted along with this one
+		d.forgetFirst(e)
+		d.track(key).targets[f.port] = f.hit
+		return true
+	}
+	d.pending.MoveToBack(e)
+	f.hit.last = now
+	f.hit.flows++
+	f.hit.bytes += r.Bytes
+	f.hit.packets += r.Packets
+	return false
+}
+
+func (d *detector) forgetFirst(e *list.Element) {
+	d.pending.Remove(e)
+	delete(d.firsts, e.Value.(*firstPort).key)
+}
+
+// track returns the track for key, starting one if there is none, and marks
+// it most recently active.
+func (d *detector) track(key trackKey) *track {
+	if e, ok := d.tracks[key]; ok {
+		d.active.MoveToBack(e)
+		return e.Value.(*track)
+	}
+	for d.max > 0 && d.active.Len() >= d.max {
+		scanEvicted.Inc()
+		d.forget(d.active.Front())
+	}
+	t := &track{key: key, targets: make(map[string]*hit)}
+	d.tracks[key] = d.active.PushBack(t)
+	return t
+}
+
+func (d *detector) forget(e *list.Element) {
+	d.active.Remove(e)
+	delete(d.tracks, e.Value.(*track).key)
+}
+
+// count records a flow to target under key, and returns an alert if that
+// takes the number of targets in the window to threshold.
+func (d *detector) count(key trackKey, r *Record, target string, threshold int, now time.Time) *Alert {
+	t := d.track(key)
+	t.device = r.SrcDevice
+	cutoff := now.Add(-d.window)
+	h, ok := t.targets[target]
+	if !ok {
+		if len(t.targets) >= threshold && t.alerted.After(cutoff) {
+			// already alerted on; more targets would only take up memory
+			return nil
+		}
+		h = &hit{}
+		t.targets[target] = h
+	}
+	h.last = now
+	h.flows++
+	h.bytes += r.Bytes
+	h.packets += r.Packets
+	if len(t.targets) < threshold {
+		return nil
+	}
+	t.prune(cutoff)
+	if len(t.targets) < threshold || t.alerted.After(cutoff) {
+		return nil
+	}
+	t.alerted = now
+	a := &Alert{
+		Timestamp:    now,
+		Kind:         key.kind,
+		Agent:        key.agent,
+		Source:       key.source,
+		SourceDevice: t.device,
+		Protocol:     key.protocol,
+		Port:         key.port,
+		Host:         key.host,
+		WindowStart:  cutoff,
+		WindowEnd:    now,
+		Targets:      len(t.targets),
+		Threshold:    threshold,
+	}
+	for target, h := range t.targets {
+		a.Examples = append(a.Examples, target)
+		a.Flows += h.flows
+		a.Bytes += h.bytes
+		a.Packets += h.packets
+	}
+	sort.Strings(a.Examples)
+	if len(a.Examples) > maxExamples {
+		a.Examples = a.Examples[:maxExamples]
+	}
+	return a
+}
+
+// run periodically forgets targets that have left the window.
+func (d *detector) run() {
+	for now := range time.Tick(d.window / 4) {
+		d.expire(now)
+	}
+}
+
+// expire drops targets last seen before the window ending now, and tracks
+// left without targets, unless they were alerted on within the window.
+func (d *detector) expire(now time.Time) {
+	cutoff := now.Add(-d.window)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range d.tracks {
+		t := e.Value.(*track)
+		t.prune(cutoff)
+		if len(t.targets) == 0 && !t.alerted.After(cutoff) {
+			d.forget(e)
+		}
+	}
+	for e := d.pending.Front(); e != nil && e.Value.(*firstPort).hit.last.Before(cutoff); e = d.pending.Front() {
+		d.forgetFirst(e)
+	}
+	scanTracked.Set(float64(len(d.tracks)))
+}
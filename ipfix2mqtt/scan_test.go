@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func withThresholds(t *testing.T, horizontal, vertical, fanout int) {
+	h, v, f := *scanHorizontal, *scanVertical, *scanFanout
+	*scanHorizontal, *scanVertical, *scanFanout = horizontal, vertical, fanout
+	t.Cleanup(func() { *scanHorizontal, *scanVertical, *scanFanout = h, v, f })
+}
+
+func TestHorizontalScan(t *testing.T) {
+	withThresholds(t, 5, 0, 0)
+	d := newDetector(nil, nil, time.Minute, 100)
+	now := time.Date(2020, 2, 17, 19, 52, 34, 0, time.UTC)
+	var alerts []*Alert
+	for i := 1; i <= 12; i++ {
+		alerts = append(alerts, d.add(&Record{
+			Agent: "gw", Protocol: "tcp", SrcAddr: "203.0.113.9", SrcPort: 40000, DstAddr: fmt.Sprintf("192.168.8.%d", i), DstPort: 22,
+			TCPFlags: []string{"SYN"}, Bytes: 60, Packets: 1,
+		}, now.Add(time.Duration(i)*time.Second))...)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1: %+v", len(alerts), alerts)
+	}
+	a := alerts[0]
+	if a.Kind != horizontalScan || a.Source != "203.0.113.9" || a.Port != 22 || a.Protocol != "tcp" || a.Targets != 5 || a.Flows != 5 || a.Bytes != 300 || len(a.Examples) != 5 || a.Examples[0] != "192.168.8.1" {
+		t.Errorf("unexpected alert: %+v", a)
+	}
+	if !a.WindowEnd.Equal(now.Add(5*time.Second)) || a.WindowEnd.Sub(a.WindowStart) != time.Minute {
+		t.Errorf("unexpected window %v-%v", a.WindowStart, a.WindowEnd)
+	}
+
+	// the scan continuing after the window is alerted on again
+	var again []*Alert
+	for i := 1; i <= 5; i++ {
+		again = append(again, d.add(&Record{
+			Agent: "gw", Protocol: "tcp", SrcAddr: "203.0.113.9", SrcPort: 40000, DstAddr: fmt.Sprintf("192.168.9.%d", i), DstPort: 22,
+		}, now.Add(2*time.Minute))...)
+	}
+	if len(again) != 1 || again[0].Targets != 5 || again[0].Examples[0] != "192.168.9.1" {
+		t.Errorf("unexpected alerts after window: %+v", again)
+	}
+}
+
+func TestVerticalScanAndFanout(t *testing.T) {
+	withThresholds(t, 0, 3, 3)
+	d := newDetector(nil, nil, time.Minute, 100)
+	now := time.Now()
+	var alerts []*Alert
+	add := func(r *Record) {
+		alerts = append(alerts, d.add(r, now)...)
+	}
+	for _, port := range []uint32{21, 22, 23} {
+		add(&Record{Protocol: "tcp", SrcAddr: "192.168.8.66", SrcPort: 40000, DstAddr: "192.168.8.1", DstPort: port, SrcInternal: true, SrcDevice: "pi"})
+	}
+	if len(alerts) != 1 || alerts[0].Kind != verticalScan || alerts[0].Host != "192.168.8.1" || alerts[0].SourceDevice != "pi" {
+		t.Fatalf("unexpected alerts: %+v", alerts)
+	}
+	alerts = nil
+	for _, dst := range []string{"192.168.8.2", "192.168.8.3"} {
+		add(&Record{Protocol: "tcp", SrcAddr: "192.168.8.66", SrcPort: 40000, DstAddr: dst, DstPort: 443, SrcInternal: true})
+	}
+	if len(alerts) != 1 || alerts[0].Kind != fanOut || alerts[0].Targets != 3 {
+		t.Fatalf("unexpected alerts: %+v", alerts)
+	}
+
+	// neither responses nor external sources fan out
+	alerts = nil
+	for i := 1; i <= 5; i++ {
+		add(&Record{Protocol: "udp", SrcAddr: "192.168.8.53", SrcPort: 53, DstAddr: fmt.Sprintf("192.168.8.%d", i), DstPort: 40000, SrcInternal: true})
+		add(&Record{Protocol: "udp", SrcAddr: "1.1.1.1", SrcPort: 40000, DstAddr: fmt.Sprintf("192.168.8.%d", i), DstPort: 40000})
+	}
+	if len(alerts) != 0 {
+		t.Errorf("unexpected alerts: %+v", alerts)
+	}
+}
+
+func TestDetectorExpiry(t *testing.T) {
+	withThresholds(t, 2, 0, 0)
+	d := newDetector(nil, nil, time.Minute, 1)
+	now := time.Now()
+	d.add(&Record{Protocol: "udp", SrcAddr: "203.0.113.9", SrcPort: 40000, DstAddr: "192.168.8.1", DstPort: 161}, now)
+	// over --scan_max_tracked
+	d.add(&Record{Protocol: "udp", SrcAddr: "203.0.113.10", SrcPort: 40000, DstAddr: "192.168.8.1", DstPort: 161}, now)
+	if len(d.tracks) != 1 {
+		t.Errorf("tracking %d sources, want 1", len(d.tracks))
+	}
+	// the first target leaves the window before the second arrives
+	if alerts := d.add(&Record{Protocol: "udp", SrcAddr: "203.0.113.9", SrcPort: 40000, DstAddr: "192.168.8.2", DstPort: 161}, now.Add(2*time.Minute)); len(alerts) != 0 {
+		t.Errorf("unexpected alerts: %+v", alerts)
+	}
+	d.expire(now.Add(4 * time.Minute))
+	if len(d.tracks) != 0 {
+		t.Errorf("tracking %d sources after expiry, want 0", len(d.tracks))
+	}
+}
+
+func TestDetectorEviction(t *testing.T) {
+	withThresholds(t, 2, 2, 0)
+	d := newDetector(nil, nil, time.Minute, 2)
+	now := time.Now()
+	// a client connecting to one port on many hosts isn't tracked for
+	// vertical scans, so doesn't push out other sources
+	d.add(&Record{Protocol: "tcp", SrcAddr: "203.0.113.9", SrcPort: 40000, DstAddr: "192.168.8.1", DstPort: 22}, now)
+	for i := 1; i <= 5; i++ {
+		d.add(&Record{Protocol: "tcp", SrcAddr: "192.168.8.66", SrcPort: 40000, DstAddr: fmt.Sprintf("198.51.100.%d", i), DstPort: 443}, now)
+	}
+	if len(d.tracks) != 2 || len(d.firsts) != 2 {
+		t.Errorf("tracking %d and remembering %d first ports, want 2 and 2", len(d.tracks), len(d.firsts))
+	}
+	// a new source pushes out the least recently active
+	d.add(&Record{Protocol: "tcp", SrcAddr: "203.0.113.10", SrcPort: 40000, DstAddr: "192.168.8.1", DstPort: 23}, now)
+	if _, ok := d.tracks[trackKey{kind: horizontalScan, source: "203.0.113.9", protocol: "tcp", port: 22}]; ok {
+		t.Error("least recently active source still tracked")
+	}
+	if _, ok := d.tracks[trackKey{kind: horizontalScan, source: "203.0.113.10", protocol: "tcp", port: 23}]; !ok {
+		t.Error("new source not tracked")
+	}
+	// a second port on a host starts tracking it, counting the first
+	alerts := d.add(&Record{Protocol: "tcp", SrcAddr: "192.168.8.66", SrcPort: 40000, DstAddr: "198.51.100.5", DstPort: 80}, now)
+	if len(alerts) != 1 || alerts[0].Kind != verticalScan || alerts[0].Targets != 2 || alerts[0].Flows != 2 {
+		t.Errorf("unexpected alerts: %+v", alerts)
+	}
+	d.expire(now.Add(2 * time.Minute))
+	if len(d.firsts) != 0 {
+		t.Errorf("remembering %d first ports after expiry, want 0", len(d.firsts))
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	usageInterval = flag.Duration("usage_interval", 0, "how often to publish per-host bandwidth usage, or 0 to disable; requires --internal_networks")
+	usageTopic    = flag.String("mqtt_topic_usage", "ipfix/usage/json", "MQTT topic to publish per-host bandwidth usage every --usage_interval")
+	dailyTopic    = flag.String("mqtt_topic_usage_daily", "ipfix/usage/daily/json", "MQTT topic to publish per-host bandwidth usage each day, or empty to disable")
+	usageTop      = flag.Int("usage_top", 10, "number of hosts using the most bandwidth to export metrics for")
+	usageMaxHosts = flag.Int("usage_max_hosts", 10000, "number of hosts to track; further hosts are counted in an overflow record")
+
+	hostBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "ipfix",
+		Name:      "host_bytes",
+		Help:      "bytes transferred by the hosts using the most bandwidth over the last usage interval",
+	}, []string{"host", "direction"})
+)
+
+func init() {
+	prometheus.MustRegister(hostBytes)
+}
+
+// Traffic is bandwidth used by a host. Upload is from the host to outside
+// the local network, and download the reverse. Counts are scaled by
+// sampling rate.
+type Traffic struct {
+	Flows           uint64 `json:"flows"`
+	UploadBytes     uint64 `json:"upload_bytes"`
+	DownloadBytes   uint64 `json:"download_bytes"`
+	UploadPackets   uint64 `json:"upload_packets"`
+	DownloadPackets uint64 `json:"download_packets"`
+}
+
+func (t *Traffic) add(o Traffic) {
+	t.Flows += o.Flows
+	t.UploadBytes += o.UploadBytes
+	t.DownloadBytes += o.DownloadBytes
+	t.UploadPackets += o.UploadPackets
+	t.DownloadPackets += o.DownloadPackets
+}
+
+// Usage is the bandwidth used by a local host over a window, in total and
+// by class of application. Hosts are identified by device name if they
+// have one, and by address otherwise.
+type Usage struct {
+	Start   time.Time `json:"window_start"`
+	End     time.Time `json:"window_end"`
+	Device  string    `json:"device,omitempty"`
+	Address string    `json:"address,omitempty"`
+	// Overflow is set for the hosts that didn't fit in --usage_max_hosts.
+	Overflow bool `json:"overflow,omitempty"`
+	Traffic
+	Classes map[string]*Traffic `json:"classes"`
+}
+
+// serviceClasses groups services into classes of application. Traffic on
+// other services is classed as "other".
+var serviceClasses = map[string]string{
+	"http":          "web",
+	"https":         "web",
+	"http-alt":      "web",
+	"domain":        "dns",
+	"domain-s":      "dns",
+	"mdns":          "dns",
+	"smtp":          "mail",
+	"submission":    "mail",
+	"submissions":   "mail",
+	"pop3":          "mail",
+	"pop3s":         "mail",
+	"imap":          "mail",
+	"imaps":         "mail",
+	"ssh":           "remote",
+	"telnet":        "remote",
+	"ms-wbt-server": "remote",
+	"openvpn":       "vpn",
+	"isakmp":        "vpn",
+	"ipsec-nat-t":   "vpn",
+	"ftp":           "file",
+	"ftp-data":      "file",
+	"tftp":          "file",
+	"microsoft-ds":  "file",
+	"netbios-ssn":   "file",
+	"stun":          "voip",
+	"mqtt":          "iot",
+	"secure-mqtt":   "iot",
+}
+
+func serviceClass(service string) string {
+	if c, ok := serviceClasses[service]; ok {
+		return c
+	}
+	return "other"
+}
+
+type hostKey struct {
+	device, address string
+}
+
+type usage struct {
+	Traffic
+	classes map[string]*Traffic
+}
+
+func (u *usage) add(class string, t Traffic) {
+	u.Traffic.add(t)
+	c, ok := u.classes[class]
+	if !ok {
+		c = &Traffic{}
+		u.classes[class] = c
+	}
+	c.add(t)
+}
+
+// usageTable is the usage of hosts over a window. The zero hostKey is the
+// overflow host.
+type usageTable map[hostKey]*usage
+
+func (u usageTable) get(k hostKey) *usage {
+	h, ok := u[k]
+	if !ok {
+		if len(u) >= *usageMaxHosts {
+			k = hostKey{}
+			if h, ok = u[k]; ok {
+				return h
+			}
+		}
+		h = &usage{classes: make(map[string]*Traffic)}
+		u[k] = h
+	}
+	return h
+}
+
+func (u usageTable) records(start, end time.Time) []*Usage {
+	records := make([]*Usage, 0, len(u))
+	for k, h := range u {
+		classes := make(map[string]*Traffic, len(h.classes))
+		for c, t := range h.classes {
+			t := *t
+			classes[c] = &t
+		}
+		records = append(records, &Usage{
+			Start:    start,
+			End:      end,
+			Device:   k.device,
+			Address:  k.address,
+			Overflow: k == hostKey{},
+			Traffic:  h.Traffic,
+			Classes:  classes,
+		})
+	}
+	return records
+}
+
+// accountant accounts for the bandwidth used by local hosts on traffic
+// crossing the edge of the local network, and publishes it every interval
+// and every day. Daily usage is lost on restart.
+type accountant struct {
+	pub    *pub.Publisher
+	redact *redact.Redactor
+
+	mu     sync.Mutex
+	start  time.Time
+	window usageTable
+	day    time.Time
+	daily  usageTable
+}
+
+func newAccountant(p *pub.Publisher, r *redact.Redactor, now time.Time) *accountant {
+	return &accountant{
+		pub:    p,
+		redact: r,
+		start:  now,
+		window: make(usageTable),
+		day:    startOfDay(now),
+		daily:  make(usageTable),
+	}
+}
+
+// startOfDay returns midnight, local time, at the start of t's day.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func (a *accountant) process(r *Record) {
+	var (
+		k hostKey
+		t = Traffic{Flows: 1}
+	)
+	switch r.Direction {
+	case "outbound":
+		k = hostKey{r.SrcDevice, r.SrcAddr}
+		t.UploadBytes, t.UploadPackets = r.Bytes, r.Packets
+	case "inbound":
+		k = hostKey{r.DstDevice, r.DstAddr}
+		t.DownloadBytes, t.DownloadPackets = r.Bytes, r.Packets
+	default:
+		return
+	}
+	if k.device != "" {
+		k.address = ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.window.get(k).add(serviceClass(r.Service), t)
+}
+
+// flush returns the usage over the window ending now, and over the previous
+// day if now is in a new one, and starts a new window. Windows spanning
+// midnight count towards the day they started in.
+func (a *accountant) flush(now time.Time) (window, daily []*Usage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	window = a.window.records(a.start, now)
+	for k, h := range a.window {
+		d := a.daily.get(k)
+		for c, t := range h.classes {
+			d.add(c, *t)
+		}
+	}
+	if day := startOfDay(now); !day.Equal(a.day) {
+		daily = a.daily.records(a.day, a.day.AddDate(0, 0, 1))
+		a.day, a.daily = day, make(usageTable)
+	}
+	a.start, a.window = now, make(usageTable, len(a.window))
+	return window, daily
+}
+
+// export sets metrics for the n records with the most bandwidth.
+func export(records []*Usage, n int) {
+	sort.Slice(records, func(i, j int) bool {
+		ri, rj := records[i], records[j]
+		return ri.UploadBytes+ri.DownloadBytes > rj.UploadBytes+rj.DownloadBytes
+	})
+	hostBytes.Reset()
+	for i, u := range records {
+		if i == n {
+			break
+		}
+		host := u.Device
+		switch {
+		case u.Overflow:
+			host = "overflow"
+		case host == "":
+			host = u.Address
+		}
+		hostBytes.WithLabelValues(host, "upload").Set(float64(u.UploadBytes))
+		hostBytes.WithLabelValues(host, "download").Set(float64(u.DownloadBytes))
+	}
+}
+
+// run publishes usage every interval.
+func (a *accountant) run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		window, daily := a.flush(now)
+		export(window, *usageTop)
+		for _, u := range window {
+			a.publish(*usageTopic, u)
+		}
+		if len(*dailyTopic) > 0 {
+			for _, u := range daily {
+				a.publish(*dailyTopic, u)
+			}
+		}
+	}
+}
+
+func (a *accountant) publish(topic string, v interface{}) {
+	out, err := encode(a.redact, v)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	go a.pub.Publish(topic, out)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAccountant(t *testing.T) {
+	start := time.Date(2020, 2, 17, 23, 50, 0, 0, time.UTC)
+	a := newAccountant(nil, nil, start)
+	for _, r := range []*Record{
+		{Direction: "outbound", SrcAddr: "192.168.8.68", SrcDevice: "laptop", Service: "https", Bytes: 100, Packets: 2},
+		{Direction: "inbound", DstAddr: "192.168.8.68", DstDevice: "laptop", Service: "https", Bytes: 5000, Packets: 5},
+		{Direction: "inbound", DstAddr: "fd00::68", DstDevice: "laptop", Service: "domain", Bytes: 80, Packets: 1},
+		{Direction: "outbound", SrcAddr: "192.168.8.70", Bytes: 300, Packets: 3},
+		{Direction: "internal", SrcAddr: "192.168.8.70", DstAddr: "192.168.8.68", Bytes: 1e6, Packets: 1000},
+		{Direction: "transit", SrcAddr: "1.1.1.1", DstAddr: "8.8.8.8", Bytes: 1e6, Packets: 1000},
+	} {
+		a.process(r)
+	}
+	window, daily := a.flush(start.Add(5 * time.Minute))
+	if len(daily) != 0 {
+		t.Errorf("daily usage published mid-day: %v", daily)
+	}
+	if len(window) != 2 {
+		t.Fatalf("got %d usage records, want 2", len(window))
+	}
+	byHost := map[string]*Usage{}
+	for _, u := range window {
+		byHost[u.Device+u.Address] = u
+	}
+	laptop := byHost["laptop"]
+	if laptop == nil || laptop.Address != "" || laptop.Flows != 3 || laptop.UploadBytes != 100 || laptop.DownloadBytes != 5080 || laptop.DownloadPackets != 6 {
+		t.Errorf("unexpected laptop usage: %+v", laptop)
+	} else if web, dns := laptop.Classes["web"], laptop.Classes["dns"]; web == nil || web.DownloadBytes != 5000 || dns == nil || dns.DownloadBytes != 80 {
+		t.Errorf("unexpected laptop classes: %+v %+v", web, dns)
+	}
+	if u := byHost["192.168.8.70"]; u == nil || u.UploadBytes != 300 || u.Classes["other"] == nil {
+		t.Errorf("unexpected 192.168.8.70 usage: %+v", u)
+	}
+
+	export(window, 1)
+	if got := testutil.ToFloat64(hostBytes.WithLabelValues("laptop", "download")); got != 5080 {
+		t.Errorf("laptop download metric = %v, want 5080", got)
+	}
+	if got := testutil.CollectAndCount(hostBytes); got != 2 {
+		t.Errorf("exported %d metrics, want 2", got)
+	}
+
+	// the window crossing midnight completes the day
+	a.process(&Record{Direction: "outbound", SrcAddr: "192.168.8.68", SrcDevice: "laptop", Service: "https", Bytes: 1000})
+	window, daily = a.flush(start.Add(15 * time.Minute))
+	if len(window) != 1 || len(daily) != 2 {
+		t.Fatalf("got %d usage and %d daily records, want 1 and 2", len(window), len(daily))
+	}
+	for _, u := range daily {
+		if !u.Start.Equal(time.Date(2020, 2, 17, 0, 0, 0, 0, time.UTC)) || !u.End.Equal(time.Date(2020, 2, 18, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("unexpected daily window %v-%v", u.Start, u.End)
+		}
+		if u.Device == "laptop" && (u.UploadBytes != 1100 || u.DownloadBytes != 5080 || u.Classes["web"].UploadBytes != 1100) {
+			t.Errorf("unexpected daily laptop usage: %+v", u)
+		}
+	}
+	if _, daily = a.flush(start.Add(20 * time.Minute)); len(daily) != 0 {
+		t.Errorf("daily usage published twice: %v", daily)
+	}
+}
+
+func TestUsageOverflow(t *testing.T) {
+	defer func(n int) { *usageMaxHosts = n }(*usageMaxHosts)
+	*usageMaxHosts = 1
+	a := newAccountant(nil, nil, time.Now())
+	for _, addr := range []string{"192.168.8.1", "192.168.8.2", "192.168.8.3"} {
+		a.process(&Record{Direction: "outbound", SrcAddr: addr, Bytes: 10})
+	}
+	window, _ := a.flush(time.Now())
+	var overflow *Usage
+	for _, u := range window {
+		if u.Overflow {
+			overflow = u
+		}
+	}
+	if len(window) != 2 || overflow == nil || overflow.Flows != 2 || overflow.UploadBytes != 20 {
+		t.Errorf("unexpected usage: %+v", window)
+	}
+}
@@ -29,6 +29,10 @@ type Publisher struct {
 	client   paho.Client
 	qos      byte
 	retained bool
+
+	wg sync.WaitGroup
+	// sem, if set, holds a token for each publish started by Go.
+	sem chan struct{}
 }
 
 // New returns a new Publisher configured with the provided qos and retention.
@@ -61,3 +65,32 @@ func (p *Publisher) Publish(topic string, message []byte) {
 	}
 	publishLatency.WithLabelValues(topic, result).Observe(float64(elapsed / time.Second))
 }
+
+// Limit makes Go block while n publishes it started are outstanding, so
+// that a fast producer can't start unboundedly many. It must be called
+// before Go.
+func (p *Publisher) Limit(n int) {
+	if n > 0 {
+		p.sem = make(chan struct{}, n)
+	}
+}
+
+// Go publishes message on topic in a new goroutine.
+func (p *Publisher) Go(topic string, message []byte) {
+	if p.sem != nil {
+		p.sem <- struct{}{}
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.Publish(topic, message)
+		if p.sem != nil {
+			<-p.sem
+		}
+	}()
+}
+
+// Wait blocks until every publish started by Go has completed.
+func (p *Publisher) Wait() {
+	p.wg.Wait()
+}
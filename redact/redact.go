@@ -0,0 +1,455 @@
+// Package redact removes or pseudonymises personal information in messages
+// before they are published.
+//
+// Rules are loaded from a JSON file, for example:
+//
+//	{
+//	  "key_file": "/etc/pubsub-logging/hmac.key",
+//	  "rules": [
+//	    {"name": "client-ip", "fields": ["client"], "action": "truncate", "ipv4_prefix": 24, "ipv6_prefix": 48},
+//	    {"name": "email", "pattern": "[^@\\s]+@[^@\\s]+\\.[a-zA-Z]+", "action": "pseudonymise"},
+//	    {"name": "username", "fields": ["content"], "pattern": "user=(\\S+)", "action": "mask"}
+//	  ]
+//	}
+//
+// A rule with fields applies only to values at those (dot-separated,
+// case-insensitive) paths; a rule without fields applies to every string
+// value. A rule with a pattern rewrites only the matching parts of a value,
+// or only its capture groups if the pattern has any.
+package redact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	register   sync.Once
+	redactions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "redact",
+		Name:      "redactions",
+		Help:      "count of values redacted",
+	}, []string{"rule"})
+)
+
+// Action is what a rule does to a matching value.
+type Action string
+
+const (
+	// Remove deletes the field entirely, or the matched text from a string.
+	Remove Action = "remove"
+	// Mask replaces the value with a fixed replacement string.
+	Mask Action = "mask"
+	// Truncate zeroes the host bits of IP addresses, leaving other values alone.
+	Truncate Action = "truncate"
+	// Pseudonymise replaces the value with a keyed hash of itself.
+	Pseudonymise Action = "pseudonymise"
+)
+
+// DefaultMask is the replacement used by Mask rules that don't specify one.
+const DefaultMask = "REDACTED"
+
+// Rule is the configuration of a single redaction rule.
+type Rule struct {
+	Name        string   `json:"name"`
+	Fields      []string `json:"fields"`
+	Pattern     string   `json:"pattern"`
+	Action      Action   `json:"action"`
+	Replacement string   `json:"replacement"`
+	IPv4Prefix  int      `json:"ipv4_prefix"`
+	IPv6Prefix  int      `json:"ipv6_prefix"`
+}
+
+// Config is the configuration of a Redactor.
+type Config struct {
+	// KeyFile holds the HMAC key for Pseudonymise rules. Collectors that
+	// share a key produce identical pseudonyms for identical values.
+	KeyFile string `json:"key_file"`
+	// KeyRotation, if set, is a duration such as "24h" after which
+	// pseudonyms change.
+	KeyRotation string `json:"key_rotation"`
+	Rules       []Rule `json:"rules"`
+}
+
+type rule struct {
+	Rule
+	fields  [][]string
+	pattern *regexp.Regexp
+}
+
+// Redactor applies a set of redaction rules to decoded JSON values. A nil
+// *Redactor leaves everything untouched.
+type Redactor struct {
+	rules []*rule
+	hash  *Hasher
+}
+
+// Load reads a Config from the JSON file at path and returns the
+// corresponding Redactor. An empty path returns a nil Redactor.
+func Load(path string) (*Redactor, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg Config
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return New(cfg)
+}
+
+// New returns a Redactor for the provided configuration.
+func New(cfg Config) (*Redactor, error) {
+	register.Do(func() {
+		prometheus.MustRegister(redactions)
+	})
+	r := &Redactor{}
+	if cfg.KeyFile != "" {
+		key, err := ReadKey(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var period time.Duration
+		if cfg.KeyRotation != "" {
+			if period, err = time.ParseDuration(cfg.KeyRotation); err != nil {
+				return nil, fmt.Errorf("key_rotation: %v", err)
+			}
+		}
+		r.hash = NewRotatingHasher(key, period)
+	}
+	for i, rc := range cfg.Rules {
+		rl := &rule{Rule: rc}
+		if rl.Name == "" {
+			rl.Name = fmt.Sprintf("rule%d", i)
+		}
+		switch rl.Action {
+		case Remove, Truncate:
+		case Mask:
+			if rl.Replacement == "" {
+				rl.Replacement = DefaultMask
+			}
+		case Pseudonymise:
+			if r.hash == nil {
+				return nil, fmt.Errorf("rule %q: pseudonymise requires key_file", rl.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rule %q: unknown action %q", rl.Name, rl.Action)
+		}
+		if rl.IPv4Prefix == 0 {
+			rl.IPv4Prefix = 24
+		}
+		if rl.IPv6Prefix == 0 {
+			rl.IPv6Prefix = 48
+		}
+		if rl.Pattern != "" {
+			re, err := regexp.Compile(rl.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %v", rl.Name, err)
+			}
+			rl.pattern = re
+		} else if len(rl.Fields) == 0 {
+			return nil, fmt.Errorf("rule %q: needs fields, a pattern, or both", rl.Name)
+		}
+		for _, f := range rl.Fields {
+			rl.fields = append(rl.fields, strings.Split(strings.ToLower(f), "."))
+		}
+		r.rules = append(r.rules, rl)
+	}
+	return r, nil
+}
+
+// ReadKey reads an HMAC key from a file, ignoring surrounding whitespace.
+func ReadKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s: empty key", path)
+	}
+	return key, nil
+}
+
+// JSON redacts a single JSON-encoded value.
+func (r *Redactor) JSON(msg []byte) ([]byte, error) {
+	if r == nil {
+		return msg, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(r.Redact(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Redact applies all rules to v, which should be a value as produced by
+// encoding/json. Maps and slices are modified in place; the redacted value is
+// returned.
+func (r *Redactor) Redact(v interface{}) interface{} {
+	if r == nil {
+		return v
+	}
+	for _, rl := range r.rules {
+		if len(rl.fields) == 0 {
+			v = r.walk(rl, v)
+			continue
+		}
+		for _, path := range rl.fields {
+			v = r.field(rl, v, path)
+		}
+	}
+	return v
+}
+
+// field applies rl to the values found at path within v.
+func (r *Redactor) field(rl *rule, v interface{}, path []string) interface{} {
+	switch t := v.(type) {
+	case []interface{}:
+		for i := range t {
+			t[i] = r.field(rl, t[i], path)
+		}
+		return t
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return t
+		}
+		for k, child := range t {
+			if strings.ToLower(k) != path[0] {
+				continue
+			}
+			if len(path) > 1 {
+				t[k] = r.field(rl, child, path[1:])
+				continue
+			}
+			if rl.Action == Remove && rl.pattern == nil {
+				delete(t, k)
+				redactions.WithLabelValues(rl.Name).Inc()
+				continue
+			}
+			t[k] = r.walk(rl, child)
+		}
+		return t
+	}
+	return v
+}
+
+// walk applies rl to every string within v.
+func (r *Redactor) walk(rl *rule, v interface{}) interface{} {
+	switch t := v.(type) {
+	case []interface{}:
+		for i := range t {
+			t[i] = r.walk(rl, t[i])
+		}
+		return t
+	case map[string]interface{}:
+		for k, child := range t {
+			t[k] = r.walk(rl, child)
+		}
+		return t
+	case string:
+		out, changed := r.apply(rl, t)
+		if changed {
+			redactions.WithLabelValues(rl.Name).Inc()
+		}
+		return out
+	}
+	return v
+}
+
+// apply rewrites s according to rl, and reports whether anything changed.
+func (r *Redactor) apply(rl *rule, s string) (string, bool) {
+	if rl.pattern == nil {
+		out := r.replace(rl, s, len(rl.fields) > 0)
+		return out, out != s
+	}
+	matches := rl.pattern.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s, false
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		// replace capture groups if there are any, otherwise the whole match
+		spans := m[2:]
+		if len(spans) == 0 {
+			spans = m[:2]
+		}
+		for i := 0; i < len(spans); i += 2 {
+			start, end := spans[i], spans[i+1]
+			if start < last {
+				continue
+			}
+			b.WriteString(s[last:start])
+			b.WriteString(r.replace(rl, s[start:end], false))
+			last = end
+		}
+	}
+	b.WriteString(s[last:])
+	out := b.String()
+	return out, out != s
+}
+
+// replace returns the redacted form of a single value. If raw is set, the
+// value may be a base64-encoded binary IP address, as found in protobuf
+// messages encoded as JSON.
+func (r *Redactor) replace(rl *rule, s string, raw bool) string {
+	switch rl.Action {
+	case Remove:
+		return ""
+	case Mask:
+		return rl.Replacement
+	case Truncate:
+		return rewriteIP(s, raw, func(ip net.IP) net.IP {
+			return TruncateIP(ip, rl.IPv4Prefix, rl.IPv6Prefix)
+		}, nil)
+	case Pseudonymise:
+		return rewriteIP(s, raw, nil, r.hash.Sum)
+	}
+	return s
+}
+
+// rewriteIP applies ipFn to s if it is an IP address (optionally with a
+// port, or base64-encoded if raw is set) and strFn to it otherwise. Hashing
+// always operates on the canonical string form of an address so that the
+// same address hashes identically whatever its encoding.
+func rewriteIP(s string, raw bool, ipFn func(net.IP) net.IP, strFn func(string) string) string {
+	ip, wrap := parseIP(s, raw)
+	if ip == nil {
+		if strFn == nil {
+			return s
+		}
+		return strFn(s)
+	}
+	if strFn != nil {
+		if raw && wrap == nil {
+			// binary fields can only hold binary pseudonyms
+			sum := HexPrefix(strFn(ip.String()), len(ip))
+			return base64.StdEncoding.EncodeToString(sum)
+		}
+		return wrap(strFn(ip.String()))
+	}
+	ip = ipFn(ip)
+	if raw && wrap == nil {
+		return base64.StdEncoding.EncodeToString(ip)
+	}
+	return wrap(ip.String())
+}
+
+// parseIP parses s as "ip", "ip:port", "[ip]:port" or, if raw is set, as
+// base64-encoded binary. It returns the address and a function that
+// rebuilds the textual form around a replacement address; wrap is nil if s
+// was binary.
+func parseIP(s string, raw bool) (ip net.IP, wrap func(string) string) {
+	if ip := net.ParseIP(s); ip != nil {
+		return normalise(ip), func(a string) string { return a }
+	}
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return normalise(ip), func(a string) string { return net.JoinHostPort(a, port) }
+		}
+	}
+	if raw {
+		if b, err := base64.StdEncoding.DecodeString(s); err == nil && (len(b) == net.IPv4len || len(b) == net.IPv6len) {
+			return normalise(net.IP(b)), nil
+		}
+	}
+	return nil, nil
+}
+
+func normalise(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+// HexPrefix decodes the first n bytes of the hex string s, such as a
+// Hasher's pseudonym, or returns n zero bytes if it is too short or not hex.
+func HexPrefix(s string, n int) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+// TruncateIP zeroes all but the first v4 bits of an IPv4 address, or the
+// first v6 bits of an IPv6 address.
+func TruncateIP(ip net.IP, v4, v6 int) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(v4, 8*net.IPv4len))
+	}
+	return ip.Mask(net.CIDRMask(v6, 8*net.IPv6len))
+}
+
+// Hasher produces keyed-HMAC pseudonyms.
+type Hasher struct {
+	key    []byte
+	period time.Duration
+
+	mu      sync.Mutex
+	epoch   int64
+	current []byte
+}
+
+// NewHasher returns a Hasher using the provided key.
+func NewHasher(key []byte) *Hasher {
+	return &Hasher{key: key}
+}
+
+// NewRotatingHasher returns a Hasher whose effective key changes every
+// period, so that pseudonyms can't be linked across periods. Periods are
+// aligned to the Unix epoch, so Hashers sharing a key and period agree on
+// pseudonyms at any given time.
+func NewRotatingHasher(key []byte, period time.Duration) *Hasher {
+	return &Hasher{key: key, period: period}
+}
+
+// Sum returns the pseudonym for s: the first 128 bits of its HMAC-SHA256, in
+// hex.
+func (h *Hasher) Sum(s string) string {
+	mac := hmac.New(sha256.New, h.keyAt(time.Now()))
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// keyAt returns the effective key at time t.
+func (h *Hasher) keyAt(t time.Time) []byte {
+	if h.period <= 0 {
+		return h.key
+	}
+	epoch := t.UnixNano() / int64(h.period)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.current == nil || epoch != h.epoch {
+		mac := hmac.New(sha256.New, h.key)
+		fmt.Fprintf(mac, "epoch:%d:%d", int64(h.period), epoch)
+		h.epoch, h.current = epoch, mac.Sum(nil)
+	}
+	return h.current
+}
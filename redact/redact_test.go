@@ -0,0 +1,166 @@
+package redact
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func keyFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "redact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(path, []byte("sekrit\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func redactJSON(t *testing.T, r *Redactor, in string) map[string]interface{} {
+	out, err := r.JSON([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(out, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRedactor_Truncate(t *testing.T) {
+	r, err := New(Config{Rules: []Rule{
+		{Name: "ip", Fields: []string{"client", "Message.QueryAddress"}, Action: Truncate},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := redactJSON(t, r, `{"client":"192.168.8.68:54439","Message":{"QueryAddress":"wKgIRA==","Other":"wKgIRA=="},"content":"192.168.8.68"}`)
+	if want, got := "192.168.8.0:54439", m["client"]; want != got {
+		t.Errorf("client = %q; want %q", got, want)
+	}
+	msg := m["Message"].(map[string]interface{})
+	if want, got := "wKgIAA==", msg["QueryAddress"]; want != got {
+		t.Errorf("Message.QueryAddress = %q; want %q", got, want)
+	}
+	if want, got := "wKgIRA==", msg["Other"]; want != got {
+		t.Errorf("Message.Other = %q; want %q", got, want)
+	}
+	if want, got := "192.168.8.68", m["content"]; want != got {
+		t.Errorf("content = %q; want %q", got, want)
+	}
+
+	m = redactJSON(t, r, `{"client":"2001:db8:1234:5678::1"}`)
+	if want, got := "2001:db8:1234::", m["client"]; want != got {
+		t.Errorf("client = %q; want %q", got, want)
+	}
+}
+
+func TestRedactor_Pattern(t *testing.T) {
+	r, err := New(Config{Rules: []Rule{
+		{Name: "user", Fields: []string{"content"}, Pattern: `user=(\S+)`, Action: Mask},
+		{Name: "mac", Pattern: `(?:[0-9a-f]{2}:){5}[0-9a-f]{2}`, Action: Remove},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := redactJSON(t, r, `{"content":"login user=miki from c8:3c:85:d3:e2:3f","tag":"user=root"}`)
+	if want, got := "login user=REDACTED from ", m["content"]; want != got {
+		t.Errorf("content = %q; want %q", got, want)
+	}
+	if want, got := "user=root", m["tag"]; want != got {
+		t.Errorf("tag = %q; want %q", got, want)
+	}
+}
+
+func TestRedactor_Pseudonymise(t *testing.T) {
+	cfg := Config{
+		KeyFile: keyFile(t),
+		Rules: []Rule{
+			{Name: "ip", Fields: []string{"client", "addr"}, Action: Pseudonymise},
+			{Name: "email", Pattern: `[^@\s]+@[^@\s]+`, Action: Pseudonymise},
+		},
+	}
+	r1, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1 := redactJSON(t, r1, `{"client":"10.1.2.3:514","content":"mail for miki@example.com"}`)
+	m2 := redactJSON(t, r2, `{"addr":"10.1.2.3"}`)
+	host, port := strings.Split(m1["client"].(string), ":")[0], strings.Split(m1["client"].(string), ":")[1]
+	if port != "514" {
+		t.Errorf("client port = %q; want 514", port)
+	}
+	if host != m2["addr"] {
+		t.Errorf("pseudonyms differ: %q vs %q", host, m2["addr"])
+	}
+	if strings.Contains(m1["content"].(string), "miki") {
+		t.Errorf("content = %q; still contains address", m1["content"])
+	}
+}
+
+func TestRedactor_Remove(t *testing.T) {
+	r, err := New(Config{Rules: []Rule{
+		{Name: "host", Fields: []string{"hostname"}, Action: Remove},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := redactJSON(t, r, `{"hostname":"miki-laptop","priority":14}`)
+	if _, ok := m["hostname"]; ok {
+		t.Errorf("hostname not removed: %v", m)
+	}
+	if want, got := float64(14), m["priority"]; want != got {
+		t.Errorf("priority = %v; want %v", got, want)
+	}
+}
+
+func TestNew_Errors(t *testing.T) {
+	for _, rl := range []Rule{
+		{Name: "nokey", Fields: []string{"client"}, Action: Pseudonymise},
+		{Name: "noaction", Fields: []string{"client"}},
+		{Name: "nothing", Action: Mask},
+		{Name: "badpattern", Pattern: "(", Action: Mask},
+	} {
+		if _, err := New(Config{Rules: []Rule{rl}}); err == nil {
+			t.Errorf("New(%q) succeeded; want error", rl.Name)
+		}
+	}
+}
+
+func TestNilRedactor(t *testing.T) {
+	var r *Redactor
+	in := []byte(`{"client":"10.1.2.3"}`)
+	out, err := r.JSON(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(in) {
+		t.Errorf("JSON() = %s; want %s", out, in)
+	}
+}
+
+func TestHasher_Rotation(t *testing.T) {
+	h := NewRotatingHasher([]byte("sekrit"), 24*time.Hour)
+	day := time.Date(2020, 2, 17, 0, 0, 0, 0, time.UTC)
+	if string(h.keyAt(day)) != string(h.keyAt(day.Add(23*time.Hour))) {
+		t.Error("key changed within a period")
+	}
+	if string(h.keyAt(day)) == string(h.keyAt(day.Add(24*time.Hour))) {
+		t.Error("key unchanged across periods")
+	}
+	if string(NewHasher([]byte("sekrit")).keyAt(day)) != "sekrit" {
+		t.Error("non-rotating key changed")
+	}
+}
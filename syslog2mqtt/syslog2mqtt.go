@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/dichro/pubsub-logging/pub"
+	"github.com/dichro/pubsub-logging/redact"
 	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
@@ -33,6 +34,7 @@ var (
 	httpAddr   = flag.String("http_listen", ":8080", "address to listen on for http requests (addr:port)")
 	mqttAddr   = flag.String("mqtt_address", "tcp://mqtt:1883", "address of MQTT broker")
 	mqttTopic  = flag.String("mqtt_topic", "syslog/raw/json", "MQTT topic to publish raw syslog messages")
+	redactCfg  = flag.String("redact_config", "", "JSON file of redaction rules to apply before publishing")
 )
 
 func init() {
@@ -43,6 +45,10 @@ func init() {
 func main() {
 	flag.Parse()
 	defer glog.Flush()
+	r, err := redact.Load(*redactCfg)
+	if err != nil {
+		glog.Exit(err)
+	}
 	ch := make(syslog.LogPartsChannel)
 	h := syslog.NewChannelHandler(ch)
 
@@ -63,16 +69,17 @@ func main() {
 	if token := mqtt.Connect(); token.Wait() && token.Error() != nil {
 		glog.Fatal(token.Error())
 	}
-	go decode(pub.New(mqtt, 1, false), ch)
+	go decode(pub.New(mqtt, 1, false), r, ch)
 
 	http.Handle("/metrics", promhttp.Handler())
 	glog.Fatal(http.ListenAndServe(*httpAddr, nil))
 }
 
-func decode(p *pub.Publisher, ch syslog.LogPartsChannel) {
+func decode(p *pub.Publisher, r *redact.Redactor, ch syslog.LogPartsChannel) {
 	for msg := range ch {
 		messageCount.Inc()
 		msg["ReceivedTimestamp"] = time.Now()
+		r.Redact(map[string]interface{}(msg))
 		var buf bytes.Buffer
 		if err := json.NewEncoder(&buf).Encode(msg); err != nil {
 			dropCount.Inc()
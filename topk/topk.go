@@ -0,0 +1,120 @@
+// Package topk finds the most frequent keys in a stream using bounded memory.
+package topk
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Entry is a key and its estimated count. The true count lies between
+// Count-Error and Count.
+type Entry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+type entry struct {
+	Entry
+	index int
+}
+
+// Sketch is a Space-Saving heavy-hitter sketch: it tracks at most capacity
+// keys, and any key occurring more than 1/capacity of the time is
+// guaranteed to be among them. A Sketch is not safe for concurrent use.
+type Sketch struct {
+	capacity int
+	keys     map[string]*entry
+	heap     minHeap
+	total    uint64
+}
+
+// New returns a Sketch tracking up to capacity keys.
+func New(capacity int) *Sketch {
+	if capacity < 1 {
+		capacity = 1
+	}
+	// keys grows as needed; a generous capacity may never be reached
+	return &Sketch{
+		capacity: capacity,
+		keys:     make(map[string]*entry),
+	}
+}
+
+// Add counts n occurrences of key.
+func (s *Sketch) Add(key string, n uint64) {
+	s.total += n
+	if e, ok := s.keys[key]; ok {
+		e.Count += n
+		heap.Fix(&s.heap, e.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		e := &entry{Entry: Entry{Key: key, Count: n}}
+		s.keys[key] = e
+		heap.Push(&s.heap, e)
+		return
+	}
+	// replace the least frequent key, which the new key may have been
+	// hiding behind all along
+	e := s.heap[0]
+	delete(s.keys, e.Key)
+	e.Key, e.Error, e.Count = key, e.Count, e.Count+n
+	s.keys[key] = e
+	heap.Fix(&s.heap, 0)
+}
+
+// Top returns up to k entries with the highest counts, most frequent first.
+func (s *Sketch) Top(k int) []Entry {
+	out := make([]Entry, 0, len(s.heap))
+	for _, e := range s.heap {
+		out = append(out, e.Entry)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if len(out) > k {
+		out = out[:k]
+	}
+	return out
+}
+
+// Total returns the sum of all counts added since the last Reset.
+func (s *Sketch) Total() uint64 {
+	return s.total
+}
+
+// Reset forgets all keys, keeping the memory allocated for them.
+func (s *Sketch) Reset() {
+	for k := range s.keys {
+		delete(s.keys, k)
+	}
+	s.heap = s.heap[:0]
+	s.total = 0
+}
+
+type minHeap []*entry
+
+func (h minHeap) Len() int           { return len(h) }
+func (h minHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h minHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *minHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *minHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
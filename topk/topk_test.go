@@ -0,0 +1,63 @@
+package topk
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSketch_Exact(t *testing.T) {
+	s := New(10)
+	for i, k := range []string{"a", "b", "c"} {
+		s.Add(k, uint64(i+1))
+	}
+	s.Add("a", 5)
+	got := s.Top(2)
+	want := []Entry{{Key: "a", Count: 6}, {Key: "c", Count: 3}}
+	if len(got) != len(want) {
+		t.Fatalf("Top(2) = %v; want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Top(2)[%d] = %v; want %v", i, got[i], want[i])
+		}
+	}
+	if s.Total() != 11 {
+		t.Errorf("Total() = %d; want 11", s.Total())
+	}
+}
+
+func TestSketch_HeavyHitters(t *testing.T) {
+	s := New(10)
+	// two heavy hitters hidden among many singletons
+	for i := 0; i < 1000; i++ {
+		s.Add(fmt.Sprint("noise", i), 1)
+		if i%3 == 0 {
+			s.Add("heavy1", 1)
+		}
+		if i%5 == 0 {
+			s.Add("heavy2", 1)
+		}
+	}
+	top := s.Top(2)
+	if len(top) != 2 || top[0].Key != "heavy1" || top[1].Key != "heavy2" {
+		t.Fatalf("Top(2) = %v; want heavy1, heavy2", top)
+	}
+	for _, e := range top {
+		if e.Count-e.Error > 334 || e.Count < 200 {
+			t.Errorf("implausible estimate %v", e)
+		}
+	}
+	if len(s.keys) > 10 {
+		t.Errorf("tracking %d keys; want at most 10", len(s.keys))
+	}
+	s.Reset()
+	if len(s.Top(10)) != 0 || s.Total() != 0 {
+		t.Errorf("Reset() left %v", s.Top(10))
+	}
+	s.Add("z", 2)
+	s.Add("y", 1)
+	s.Add("z", 1)
+	if got, want := s.Top(10), []Entry{{Key: "z", Count: 3}, {Key: "y", Count: 1}}; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Top(10) after Reset() = %v; want %v", got, want)
+	}
+}